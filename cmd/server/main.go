@@ -14,28 +14,158 @@
 
 package main
 
-import "github.com/momirjalili/httpsd/internal/raft"
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/momirjalili/httpsd/internal/api"
+	"github.com/momirjalili/httpsd/internal/config"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"github.com/momirjalili/httpsd/internal/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
 
 func main() {
-	// cluster := flag.String("cluster", "http://127.0.0.1:9021", "comma separated cluster peers")
-	// id := flag.Int("id", 1, "node ID")
-	// kvport := flag.Int("port", 9121, "key-value server port")
-	// join := flag.Bool("join", false, "join an existing cluster")
-	// flag.Parse()
-
-	// proposeC := make(chan string)
-	// defer close(proposeC)
-	// confChangeC := make(chan raftpb.ConfChange)
-	// defer close(confChangeC)
-
-	// // raft provides a commit stream for the proposals from the http api
-	// var kvs *raft.KVStore
-	// getSnapshot := func() ([]byte, error) { return kvs.GetSnapshot() }
-	// commitC, errorC, snapshotterReady := raft.NewRaftNode(*id, strings.Split(*cluster, ","), *join, getSnapshot, proposeC, confChangeC)
-
-	// kvs = raft.NewKVStore(<-snapshotterReady, proposeC, commitC, errorC)
-
-	// the key-value http handler will propose updates to raft
-	// raft.ServeHttpKVAPI(kvs, *kvport, confChangeC, errorC)
-	raft.ServeHttpSDAPI()
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	forwardMode, err := api.ParseForwardMode(cfg.Forward)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(cfg.DataDir, 0750); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bolt.Open(cfg.DBPath(), 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := httpsd.New(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(httpsd.NewCollector(store))
+
+	proposeC := make(chan string)
+	confChangeC := make(chan raftpb.ConfChange)
+
+	// raft provides a commit stream for the commands proposed by the sd api
+	var sds *raft.SDStore
+	getSnapshot := func() ([]byte, error) { return sds.GetSnapshot() }
+	commitC, errorC, snapshotterReady, node := raft.NewRaftNodeFromConfig(raft.Config{
+		ID:            cfg.ID,
+		Peers:         cfg.Peers,
+		Join:          cfg.Join,
+		ListenAddr:    cfg.RaftListen,
+		WALDir:        cfg.WALDir(),
+		SnapDir:       cfg.SnapDir(),
+		Storage:       cfg.RaftStorage,
+		BoltPath:      cfg.RaftDBPath(),
+		SnapshotCount: cfg.SnapshotCount,
+		TickInterval:  cfg.TickInterval,
+		ElectionTick:  cfg.ElectionTicks,
+		HeartbeatTick: cfg.HeartbeatTicks,
+		TLSInfo:       cfg.PeerTLSInfo(),
+	}, getSnapshot, proposeC, confChangeC)
+
+	sds = raft.NewSDStore(cfg.ID, <-snapshotterReady, node, store, proposeC, commitC, errorC)
+	sds.MaxApplyLag = cfg.ReadyMaxLag
+
+	publishCtx, cancelPublish := context.WithCancel(context.Background())
+	go sds.Publish(publishCtx, cfg.AdvertiseAPIURL)
+
+	// the sd http handlers will propose updates to raft
+	var auth *api.AuthConfig
+	if cfg.AuthEnabled {
+		auth = &api.AuthConfig{AnonymousDiscover: cfg.DiscoverAuth == "anonymous"}
+		if cfg.AdminTokenFile != "" {
+			secret, err := ioutil.ReadFile(cfg.AdminTokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(strings.TrimSpace(string(secret))) == 0 {
+				log.Fatalf("admin token file %s is empty", cfg.AdminTokenFile)
+			}
+			auth.AdminTokenHash = httpsd.HashToken(strings.TrimSpace(string(secret)))
+		}
+	}
+	srv, err := raft.NewHttpSDServer(sds, cfg.APIListen, forwardMode, cfg.APITLSInfo(), auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		serve := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			// certificates come from the TLS config and are reloaded on every handshake
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigC:
+		log.Printf("received %s, shutting down", sig)
+	case err, ok := <-errorC:
+		// exit when raft goes down
+		if ok {
+			log.Fatal(err)
+		}
+		log.Printf("raft stopped, shutting down")
+	}
+
+	// the timeout bounds draining and the leadership transfer, stopping
+	// raft and closing bolt only wait for in-flight commits
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	cancelPublish()
+	if err := shutdown(ctx, sigC, srv, sds, store); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("shutdown complete")
+}
+
+// errSecondSignal is returned by shutdown when it is interrupted.
+var errSecondSignal = errors.New("received second signal, exiting")
+
+// shutdown drains the HTTP requests of srv, stops raft and closes the bolt
+// store, in this order. It returns errSecondSignal as soon as a signal
+// arrives on sigC before it is done.
+func shutdown(ctx context.Context, sigC <-chan os.Signal, srv interface{ Shutdown(context.Context) error }, sds interface{ Stop(context.Context) }, store io.Closer) error {
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("draining http requests failed (%v)", err)
+		}
+		sds.Stop(ctx)
+		if err := store.Close(); err != nil {
+			log.Printf("closing bolt store failed (%v)", err)
+		}
+	}()
+	select {
+	case <-donec:
+		return nil
+	case <-sigC:
+		return errSecondSignal
+	}
 }
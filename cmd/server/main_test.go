@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// steps records the shutdown steps in the order they are done.
+type steps struct {
+	mu   sync.Mutex
+	done []string
+}
+
+func (s *steps) add(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = append(s.done, step)
+}
+
+func (s *steps) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.done...)
+}
+
+// stopFunc is the raft node, stopping with stop.
+type stopFunc func()
+
+func (f stopFunc) Stop(ctx context.Context) { f() }
+
+// closeFunc is the bolt store, closing with close.
+type closeFunc func()
+
+func (f closeFunc) Close() error {
+	f()
+	return nil
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var s steps
+	inflight := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(inflight)
+		<-release
+		s.add("http drained")
+	}))
+	defer srv.Close()
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	<-inflight
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- shutdown(context.Background(), make(chan os.Signal), srv.Config,
+			stopFunc(func() { s.add("raft stopped") }), closeFunc(func() { s.add("bolt closed") }))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if got := s.list(); len(got) != 0 {
+		t.Fatalf("shutdown did %v while a request was in flight", got)
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http drained", "raft stopped", "bolt closed"}
+	if got := s.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("shutdown steps = %v, want %v", got, want)
+	}
+}
+
+func TestShutdownSecondSignal(t *testing.T) {
+	srv := &http.Server{}
+	stopping := make(chan struct{})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	raft := stopFunc(func() {
+		close(stopping)
+		<-stuck
+	})
+	sigC := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- shutdown(context.Background(), sigC, srv, raft, closeFunc(func() {})) }()
+	<-stopping
+	sigC <- syscall.SIGTERM
+	select {
+	case err := <-errc:
+		if err != errSecondSignal {
+			t.Errorf("shutdown: err = %v, want %v", err, errSecondSignal)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown ignored a second signal")
+	}
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// TokenStore holds the API tokens. Mutations block until they are applied.
+type TokenStore interface {
+	GetTokenByHash(hash string) (*httpsd.Token, bool)
+	GetTokens() ([]httpsd.Token, error)
+	CreateToken(ctx context.Context, t *httpsd.Token) (*httpsd.Token, error)
+	DeleteToken(ctx context.Context, id uint64) error
+}
+
+// AuthConfig enables bearer token authentication on SDServer.
+type AuthConfig struct {
+	Tokens TokenStore
+	// AdminTokenHash is the hash of an admin token taken from the local
+	// configuration, used to create the first replicated tokens.
+	AdminTokenHash string
+	// AnonymousDiscover leaves the discover endpoint open to anyone.
+	AnonymousDiscover bool
+}
+
+// EnableAuth requires a bearer token on every handler wrapped by Authorize.
+func (sd *SDServer) EnableAuth(cfg AuthConfig) {
+	sd.auth = &cfg
+}
+
+// Authorize wraps a handler so that it only runs for requests carrying a
+// token with the given scope. It does nothing unless auth is enabled.
+func (sd *SDServer) Authorize(scope httpsd.Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if sd.auth == nil || scope == httpsd.ScopeDiscover && sd.auth.AnonymousDiscover {
+			h(w, req)
+			return
+		}
+		secret := bearerToken(req)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="httpsd"`)
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		token, ok := sd.lookupToken(secret)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="httpsd", error="invalid_token"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		if !token.Scope.Allows(scope) {
+			http.Error(w, "token does not grant "+string(scope), http.StatusForbidden)
+			return
+		}
+		h(w, req.WithContext(context.WithValue(req.Context(), tokenKey{}, token)))
+	}
+}
+
+type tokenKey struct{}
+
+// tokenFromContext returns the token the request was authorized with, nil
+// if it was not authenticated.
+func tokenFromContext(ctx context.Context) *httpsd.Token {
+	t, _ := ctx.Value(tokenKey{}).(*httpsd.Token)
+	return t
+}
+
+// groupRole returns the role the request has on a target group with the
+// given ID and labels. Requests that were not authenticated, because auth
+// is disabled or the route is open, are admins.
+func groupRole(req *http.Request, id uint64, labels map[string]interface{}) httpsd.Role {
+	token := tokenFromContext(req.Context())
+	if token == nil {
+		return httpsd.RoleAdmin
+	}
+	return token.GroupRole(id, labels)
+}
+
+// commandAuth returns the token of the request without its hash, for
+// target group commands to check its roles again when they are applied. It
+// is nil if the request was not authenticated.
+func commandAuth(req *http.Request) *httpsd.Token {
+	token := tokenFromContext(req.Context())
+	if token == nil {
+		return nil
+	}
+	auth := *token
+	auth.Hash = ""
+	return &auth
+}
+
+// authorizeGroup reports whether the request has the required role on a
+// target group, and writes the error otherwise. Groups the request may not
+// read are reported as not found, so their existence does not leak.
+func authorizeGroup(w http.ResponseWriter, req *http.Request, id uint64, labels map[string]interface{}, required httpsd.Role) bool {
+	role := groupRole(req, id, labels)
+	switch {
+	case role.Allows(required):
+		return true
+	case !role.Allows(httpsd.RoleReader):
+		http.Error(w, httpsd.ErrTargetGroupNotFound.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "token is not "+string(required)+" of target group "+strconv.FormatUint(id, 10), http.StatusForbidden)
+	}
+	return false
+}
+
+// authorizeLabels reports whether the request has the required role on a
+// target group with the labels it would have once created or changed, and
+// writes the error otherwise. It keeps tokens from moving groups out of their grants or
+// into someone else's.
+func authorizeLabels(w http.ResponseWriter, req *http.Request, id uint64, labels map[string]interface{}, required httpsd.Role) bool {
+	if groupRole(req, id, labels).Allows(required) {
+		return true
+	}
+	http.Error(w, "token is not "+string(required)+" of target groups with these labels", http.StatusForbidden)
+	return false
+}
+
+// readableGroups drops the target groups the request may not read.
+func readableGroups(req *http.Request, tgs []httpsd.TargetGroup) []httpsd.TargetGroup {
+	if tokenFromContext(req.Context()) == nil {
+		return tgs
+	}
+	readable := tgs[:0]
+	for _, tg := range tgs {
+		if groupRole(req, tg.ID, tg.Labels).Allows(httpsd.RoleReader) {
+			readable = append(readable, tg)
+		}
+	}
+	return readable
+}
+
+func (sd *SDServer) lookupToken(secret string) (*httpsd.Token, bool) {
+	hash := httpsd.HashToken(secret)
+	if sd.auth.AdminTokenHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(sd.auth.AdminTokenHash)) == 1 {
+		return &httpsd.Token{Name: "config", Scope: httpsd.ScopeAdmin}, true
+	}
+	return sd.auth.Tokens.GetTokenByHash(hash)
+}
+
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// tokenView is a token as listed by the API, without its hash.
+type tokenView struct {
+	ID        uint64         `json:"id"`
+	Name      string         `json:"name"`
+	Scope     httpsd.Scope   `json:"scope"`
+	Grants    []httpsd.Grant `json:"grants,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	// Token is the secret, only returned when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+func newTokenView(t *httpsd.Token) tokenView {
+	return tokenView{ID: t.ID, Name: t.Name, Scope: t.Scope, Grants: t.Grants, CreatedAt: t.CreatedAt}
+}
+
+// GET /api/v1/tokens    lists the API tokens
+func (sd *SDServer) ListTokensHandler(w http.ResponseWriter, req *http.Request) {
+	if sd.auth == nil {
+		http.Error(w, "authentication is disabled", http.StatusNotFound)
+		return
+	}
+	tokens, err := sd.auth.Tokens.GetTokens()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := make([]tokenView, 0, len(tokens))
+	for i := range tokens {
+		views = append(views, newTokenView(&tokens[i]))
+	}
+	renderJSON(w, map[string][]tokenView{"tokens": views})
+}
+
+// POST /api/v1/tokens    creates a token {"name": ..., "scope": ..., "grants": [...]} and returns its secret
+func (sd *SDServer) CreateTokenHandler(w http.ResponseWriter, req *http.Request) {
+	if sd.auth == nil {
+		http.Error(w, "authentication is disabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Name   string         `json:"name"`
+		Scope  httpsd.Scope   `json:"scope"`
+		Grants []httpsd.Grant `json:"grants"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, g := range body.Grants {
+		if err := g.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Scope == "" && len(body.Grants) > 0 {
+		body.Scope = httpsd.ScopeForGrants(body.Grants)
+	}
+	if !body.Scope.Valid() {
+		http.Error(w, "scope must be discover, read, write or admin", http.StatusBadRequest)
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	created, err := sd.auth.Tokens.CreateToken(req.Context(), &httpsd.Token{
+		Name:      body.Name,
+		Hash:      httpsd.HashToken(secret),
+		Scope:     body.Scope,
+		Grants:    body.Grants,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("created %s token %d (%s)", created.Scope, created.ID, created.Name)
+	view := newTokenView(created)
+	view.Token = secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+// DELETE /api/v1/tokens/<token_id>    revokes a token
+func (sd *SDServer) DeleteTokenHandler(w http.ResponseWriter, req *http.Request) {
+	if sd.auth == nil {
+		http.Error(w, "authentication is disabled", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(req)["token_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide token id", http.StatusBadRequest)
+		return
+	}
+	if err := sd.auth.Tokens.DeleteToken(req.Context(), id); err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("deleted token %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
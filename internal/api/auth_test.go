@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// groupIDs returns the IDs of the target groups of a list response.
+func groupIDs(t *testing.T, body []byte) []uint64 {
+	t.Helper()
+	var tgs []httpsd.TargetGroup
+	if err := json.Unmarshal(body, &tgs); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	ids := []uint64{}
+	for _, tg := range tgs {
+		ids = append(ids, tg.ID)
+	}
+	return ids
+}
+
+func TestAuthReaderCannotWrite(t *testing.T) {
+	store := newMemStore(t)
+	tg := store.createGroup(t, &httpsd.TargetGroup{Labels: map[string]interface{}{"team": "a"}})
+	sd := NewSDServer(store, nil, ForwardProxy)
+	sd.EnableAuth(AuthConfig{Tokens: store})
+	router := newTestRouter(sd)
+	reader := store.createToken(t, httpsd.ScopeRead)
+	// a write scope limited to reading the group by its grant
+	granted := store.createToken(t, httpsd.ScopeWrite, httpsd.Grant{Role: httpsd.RoleReader, GroupID: tg.ID})
+	group := "/api/v1/target/" + strconv.FormatUint(tg.ID, 10) + "/"
+	update := `{"targets": [{"addr": "10.0.0.1:9100"}]}`
+
+	for _, tc := range []struct {
+		secret, method, target, body string
+	}{
+		{reader, "POST", "/api/v1/target/", `{"labels": {"team": "a"}}`},
+		{reader, "PUT", group, update},
+		{reader, "DELETE", group, ""},
+		{reader, "PUT", "/api/v1/jobs/node", `{"match": "team=a"}`},
+		{granted, "PUT", group, update},
+		{granted, "DELETE", group, ""},
+	} {
+		if rec := serve(router, tc.method, tc.target, tc.body, bearer(tc.secret)...); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s with %s = %d %q, want 403", tc.method, tc.target, tc.secret, rec.Code, rec.Body)
+		}
+	}
+	if got, err := store.GetTargetGroup(tg.ID); err != nil || len(got.Targets) != 0 {
+		t.Errorf("target group after forbidden writes = %+v, %v, want it unchanged", got, err)
+	}
+	if rec := serve(router, "GET", group, "", bearer(reader)...); rec.Code != http.StatusOK {
+		t.Errorf("GET %s with a reader token = %d, want 200", group, rec.Code)
+	}
+}
+
+func TestAuthGrantsLimitReads(t *testing.T) {
+	store := newMemStore(t)
+	mine := store.createGroup(t, &httpsd.TargetGroup{Labels: map[string]interface{}{"team": "a"}, Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}})
+	other := store.createGroup(t, &httpsd.TargetGroup{Labels: map[string]interface{}{"team": "b"}, Targets: []httpsd.Target{{Addr: "10.0.0.2:9100"}}})
+	sd := NewSDServer(store, nil, ForwardProxy)
+	sd.EnableAuth(AuthConfig{Tokens: store})
+	router := newTestRouter(sd)
+	all := store.createToken(t, httpsd.ScopeRead)
+	team := store.createToken(t, httpsd.ScopeRead, httpsd.Grant{Role: httpsd.RoleReader, Selector: map[string]string{"team": "a"}})
+
+	rec := serve(router, "GET", "/api/v1/target/", "", bearer(team)...)
+	if got := groupIDs(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []uint64{mine.ID}) {
+		t.Errorf("target groups of a granted token = %v, want [%d]", got, mine.ID)
+	}
+	rec = serve(router, "GET", "/api/v1/target/", "", bearer(all)...)
+	if got := groupIDs(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []uint64{mine.ID, other.ID}) {
+		t.Errorf("target groups of an unlimited token = %v, want both", got)
+	}
+	// groups the token cannot read do not exist for it
+	rec = serve(router, "GET", "/api/v1/target/"+strconv.FormatUint(other.ID, 10)+"/", "", bearer(team)...)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET another team's group = %d, want 404", rec.Code)
+	}
+
+	rec = serve(router, "GET", "/api/v1/discover", "", bearer(team)...)
+	if got := discoverTargets(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []string{"10.0.0.1:9100"}) {
+		t.Errorf("discover with a granted token = %v, want only its group", got)
+	}
+	rec = serve(router, "GET", "/api/v1/discover?match=team=b", "", bearer(team)...)
+	if got := discoverTargets(t, rec.Body.Bytes()); len(got) != 0 {
+		t.Errorf("discover of another team with a granted token = %v, want none", got)
+	}
+}
+
+func TestAuthDiscoverAnonymous(t *testing.T) {
+	store := newMemStore(t)
+	store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}})
+
+	// auth disabled: everything is open
+	router := newTestRouter(NewSDServer(store, nil, ForwardProxy))
+	for _, target := range []string{"/api/v1/discover", "/api/v1/target/"} {
+		if rec := serve(router, "GET", target, ""); rec.Code != http.StatusOK {
+			t.Errorf("GET %s without auth = %d, want 200", target, rec.Code)
+		}
+	}
+
+	for _, tc := range []struct {
+		anonymous bool
+		discover  int
+	}{
+		{true, http.StatusOK},
+		{false, http.StatusUnauthorized},
+	} {
+		sd := NewSDServer(store, nil, ForwardProxy)
+		sd.EnableAuth(AuthConfig{Tokens: store, AnonymousDiscover: tc.anonymous})
+		router := newTestRouter(sd)
+		rec := serve(router, "GET", "/api/v1/discover", "")
+		if rec.Code != tc.discover {
+			t.Errorf("anonymous discover = %t: discover without a token = %d, want %d", tc.anonymous, rec.Code, tc.discover)
+		}
+		if rec.Code == http.StatusOK {
+			if got := discoverTargets(t, rec.Body.Bytes()); len(got) != 1 {
+				t.Errorf("anonymous discover = %v, want every target", got)
+			}
+		}
+		if rec := serve(router, "GET", "/api/v1/target/", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous discover = %t: target groups without a token = %d, want 401", tc.anonymous, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// Member is a raft member of the cluster as listed by the cluster API.
+type Member struct {
+	ID        uint64   `json:"id"`
+	PeerURLs  []string `json:"peer_urls"`
+	APIURL    string   `json:"api_url,omitempty"`
+	IsLearner bool     `json:"is_learner"`
+	IsLeader  bool     `json:"is_leader"`
+}
+
+// memberError writes the HTTP error matching an error returned by a
+// membership change.
+func memberError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, httpsd.ErrMemberNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, httpsd.ErrMemberExists), errors.Is(err, httpsd.ErrMemberNotLearner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "change not applied: "+err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GET /api/v1/cluster/members    lists the members of the cluster
+func (sd *SDServer) ListMembersHandler(w http.ResponseWriter, req *http.Request) {
+	members, err := sd.cluster.Members()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderJSON(w, map[string][]Member{"members": members})
+}
+
+// POST /api/v1/cluster/members    adds a voter or, with is_learner set, a learner
+func (sd *SDServer) AddMemberHandler(w http.ResponseWriter, req *http.Request) {
+	var m Member
+	if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(m.PeerURLs) == 0 {
+		http.Error(w, "peer_urls is required", http.StatusBadRequest)
+		return
+	}
+	if m.ID == 0 {
+		members, err := sd.cluster.Members()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, cur := range members {
+			if cur.ID >= m.ID {
+				m.ID = cur.ID + 1
+			}
+		}
+	}
+	log.Printf("adding member %d with peer urls %v (learner: %t)", m.ID, m.PeerURLs, m.IsLearner)
+	added, err := sd.cluster.AddMember(req.Context(), m)
+	if err != nil {
+		memberError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(added)
+}
+
+// DELETE /api/v1/cluster/members/<member_id>    removes a member
+func (sd *SDServer) RemoveMemberHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["member_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide member id", http.StatusBadRequest)
+		return
+	}
+	log.Printf("removing member %d", id)
+	if err := sd.cluster.RemoveMember(req.Context(), id); err != nil {
+		memberError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/v1/cluster/members/<member_id>/promote    promotes a learner to a voter
+func (sd *SDServer) PromoteMemberHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["member_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide member id", http.StatusBadRequest)
+		return
+	}
+	log.Printf("promoting member %d", id)
+	promoted, err := sd.cluster.PromoteMember(req.Context(), id)
+	if err != nil {
+		memberError(w, err)
+		return
+	}
+	renderJSON(w, promoted)
+}
+
+// ClusterStatus is the raft state of the node answering the request.
+type ClusterStatus struct {
+	ID        uint64 `json:"id"`
+	Leader    uint64 `json:"leader"`
+	RaftState string `json:"raft_state"`
+	Term      uint64 `json:"term"`
+	Vote      uint64 `json:"vote"`
+	// CommitIndex and AppliedIndex are the raft log positions, StoreAppliedIndex
+	// is the last command applied to the target store.
+	CommitIndex       uint64              `json:"commit_index"`
+	AppliedIndex      uint64              `json:"applied_index"`
+	StoreAppliedIndex uint64              `json:"store_applied_index"`
+	SnapshotIndex     uint64              `json:"snapshot_index"`
+	WALDir            string              `json:"wal_dir"`
+	SnapDir           string              `json:"snap_dir"`
+	Progress          map[uint64]Progress `json:"progress,omitempty"`
+	ServerStats       json.RawMessage     `json:"server_stats,omitempty"`
+	LeaderStats       json.RawMessage     `json:"leader_stats,omitempty"`
+}
+
+// Progress is the replication progress of a member, as seen by the leader.
+type Progress struct {
+	Match        uint64 `json:"match"`
+	Next         uint64 `json:"next"`
+	State        string `json:"state"`
+	RecentActive bool   `json:"recent_active"`
+	Paused       bool   `json:"paused"`
+	IsLearner    bool   `json:"is_learner"`
+}
+
+// GET /api/v1/cluster/status    raft status of this node, progress of the followers on the leader
+func (sd *SDServer) ClusterStatusHandler(w http.ResponseWriter, req *http.Request) {
+	status, err := sd.cluster.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderJSON(w, status)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// memberCluster is a Cluster of members whose membership changes
+// fail with err.
+type memberCluster struct {
+	stubCluster
+	members []Member
+	err     error
+}
+
+func (c *memberCluster) Members() ([]Member, error) { return c.members, nil }
+func (c *memberCluster) AddMember(ctx context.Context, m Member) (*Member, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &m, nil
+}
+func (c *memberCluster) RemoveMember(ctx context.Context, id uint64) error { return c.err }
+func (c *memberCluster) PromoteMember(ctx context.Context, id uint64) (*Member, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &Member{ID: id}, nil
+}
+
+func newClusterRouter(c Cluster) *mux.Router {
+	sd := NewSDServer(nil, c, ForwardProxy)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/cluster/members", sd.AddMemberHandler).Methods("POST")
+	router.HandleFunc("/api/v1/cluster/members/{member_id}", sd.RemoveMemberHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/cluster/members/{member_id}/promote", sd.PromoteMemberHandler).Methods("POST")
+	return router
+}
+
+func TestClusterHandlerErrors(t *testing.T) {
+	const member = `{"peer_urls": ["http://10.0.0.2:2380"]}`
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		err    error
+		code   int
+	}{
+		{"add invalid json", "POST", "/api/v1/cluster/members", "{", nil, http.StatusBadRequest},
+		{"add without peer urls", "POST", "/api/v1/cluster/members", `{"id": 2}`, nil, http.StatusBadRequest},
+		{"add existing", "POST", "/api/v1/cluster/members", member, httpsd.ErrMemberExists, http.StatusConflict},
+		{"add not applied", "POST", "/api/v1/cluster/members", member, context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"add failing", "POST", "/api/v1/cluster/members", member, errors.New("raft stopped"), http.StatusInternalServerError},
+		{"remove invalid id", "DELETE", "/api/v1/cluster/members/two", "", nil, http.StatusBadRequest},
+		{"remove missing", "DELETE", "/api/v1/cluster/members/9", "", httpsd.ErrMemberNotFound, http.StatusNotFound},
+		{"promote invalid id", "POST", "/api/v1/cluster/members/two/promote", "", nil, http.StatusBadRequest},
+		{"promote missing", "POST", "/api/v1/cluster/members/9/promote", "", httpsd.ErrMemberNotFound, http.StatusNotFound},
+		{"promote voter", "POST", "/api/v1/cluster/members/1/promote", "", httpsd.ErrMemberNotLearner, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		router := newClusterRouter(&memberCluster{err: tt.err})
+		if rec := serve(router, tt.method, tt.target, tt.body); rec.Code != tt.code {
+			t.Errorf("%s: %s %s = %d %q, want %d", tt.name, tt.method, tt.target, rec.Code, rec.Body, tt.code)
+		}
+	}
+}
+
+func TestAddMemberAssignsID(t *testing.T) {
+	c := &memberCluster{members: []Member{{ID: 1}, {ID: 3}}}
+	rec := serve(newClusterRouter(c), "POST", "/api/v1/cluster/members", `{"peer_urls": ["http://10.0.0.4:2380"], "is_learner": true}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST = %d %q, want %d", rec.Code, rec.Body, http.StatusCreated)
+	}
+	var added Member
+	if err := json.Unmarshal(rec.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	want := Member{ID: 4, PeerURLs: []string{"http://10.0.0.4:2380"}, IsLearner: true}
+	if !reflect.DeepEqual(added, want) {
+		t.Errorf("added member = %+v, want %+v", added, want)
+	}
+}
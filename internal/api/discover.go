@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// discoverBody is a serialised discover response at a store revision.
+type discoverBody struct {
+	etag string
+	json []byte
+	gzip []byte // json gzip-compressed
+}
+
+// maxDiscoverCacheEntries bounds the number of discover responses, by job
+// and selector, cached at a revision.
+const maxDiscoverCacheEntries = 64
+
+// discoverCache holds the discover responses of the latest revision by
+// job and selector, so that polls between two mutations are served without
+// touching the store.
+type discoverCache struct {
+	mu       sync.Mutex
+	revision uint64
+	bodies   map[string]*discoverBody
+}
+
+// get returns the cached body for the key if it is of the given
+// revision, or builds and caches a new one.
+func (c *discoverCache) get(revision uint64, key string, build func() ([]byte, error)) (*discoverBody, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bodies == nil || c.revision != revision {
+		c.revision = revision
+		c.bodies = map[string]*discoverBody{}
+	}
+	if body, ok := c.bodies[key]; ok {
+		return body, nil
+	}
+	js, err := build()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(js); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	body := &discoverBody{etag: `"` + strconv.FormatUint(revision, 10) + `"`, json: js, gzip: buf.Bytes()}
+	if len(c.bodies) < maxDiscoverCacheEntries {
+		c.bodies[key] = body
+	}
+	return body, nil
+}
+
+// GET /api/v1/discover?match=<selector>    target groups in the prometheus http_sd format
+//
+// The optional match parameters select groups by label, see
+// httpsd.ParseSelector; groups must match all of them.
+//
+// The response carries an ETag of the store revision and is answered with
+// 304 Not Modified when it matches If-None-Match. Responses for tokens
+// limited by grants are built for each request, the others are cached
+// until the next mutation is applied.
+func (sd *SDServer) DiscoverHandler(w http.ResponseWriter, req *http.Request) {
+	sel, ok := matchSelector(w, req)
+	if !ok || !sd.readConsistency(w, req) {
+		return
+	}
+	sd.serveDiscover(w, req, sd.store.Revision(), "", sel, nil)
+}
+
+// GET /api/v1/discover/<job>?match=<selector>    target groups of a job in the prometheus http_sd format
+func (sd *SDServer) JobDiscoverHandler(w http.ResponseWriter, req *http.Request) {
+	sel, ok := matchSelector(w, req)
+	if !ok || !sd.readConsistency(w, req) {
+		return
+	}
+	// read the revision before the job, so that a job changed in between
+	// is not cached under the older revision
+	revision := sd.store.Revision()
+	job, err := sd.store.GetJob(mux.Vars(req)["job"])
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jobSel, err := job.Selector()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sd.serveDiscover(w, req, revision, job.Name, append(jobSel, sel...), job.Labels)
+}
+
+// matchSelector parses the match parameters of a discover request, and
+// writes the error if they are invalid.
+func matchSelector(w http.ResponseWriter, req *http.Request) (httpsd.Selector, bool) {
+	var sel httpsd.Selector
+	for _, m := range req.URL.Query()["match"] {
+		s, err := httpsd.ParseSelector(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		sel = append(sel, s...)
+	}
+	return sel, true
+}
+
+// serveDiscover writes the groups matching sel with labels added, as of
+// revision. job names the discover view in the cache, "" for the groups
+// themselves.
+func (sd *SDServer) serveDiscover(w http.ResponseWriter, req *http.Request, revision uint64, job string, sel httpsd.Selector, labels map[string]string) {
+	var (
+		body *discoverBody
+		err  error
+	)
+	build := func() ([]byte, error) { return sd.buildDiscover(req, sel, labels) }
+	if token := tokenFromContext(req.Context()); token != nil && len(token.Grants) > 0 {
+		etag := `"` + strconv.FormatUint(revision, 10) + "-" + strconv.FormatUint(token.ID, 10) + `"`
+		if notModified(w, req, etag) {
+			return
+		}
+		var js []byte
+		if js, err = build(); err == nil {
+			body = &discoverBody{etag: etag, json: js}
+		}
+	} else {
+		if notModified(w, req, `"`+strconv.FormatUint(revision, 10)+`"`) {
+			return
+		}
+		// job names have no '?', the key is unambiguous
+		body, err = sd.cache.get(revision, job+"?"+sel.String(), build)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", body.etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if body.gzip != nil && acceptsGzip(req) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body.gzip)
+		return
+	}
+	w.Write(body.json)
+}
+
+// buildDiscover reads the target groups the request may read, splits them
+// by target labels and serialises those matching sel in the http_sd format,
+// with labels set on every group.
+func (sd *SDServer) buildDiscover(req *http.Request, sel httpsd.Selector, labels map[string]string) ([]byte, error) {
+	start := time.Now()
+	allTGs, err := sd.store.GetAllTargetGroups()
+	if err != nil {
+		return nil, err
+	}
+	resp := []map[string]interface{}{}
+
+	for _, tg := range readableGroups(req, allTGs) {
+		for _, g := range splitTargetGroup(tg) {
+			if !sel.Matches(g.Labels) {
+				continue
+			}
+			if len(labels) > 0 {
+				g.Labels = mergeLabels(g.Labels, nil)
+				for k, v := range labels {
+					g.Labels[k] = v
+				}
+			}
+			resp = append(resp, map[string]interface{}{"labels": g.Labels, "targets": g.Targets})
+		}
+	}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	discoverBuild.Observe(time.Since(start).Seconds())
+	discoverSize.Observe(float64(len(js)))
+	return js, nil
+}
+
+// discoverGroup is a group of the http_sd format: targets sharing labels.
+type discoverGroup struct {
+	Labels  map[string]interface{}
+	Targets []string
+}
+
+// splitTargetGroup splits tg into one group per distinct set of target
+// labels, each with the group's labels and the target labels on top, in
+// the order the sets first appear. Targets without labels, and groups
+// without targets, come first with the group's labels.
+func splitTargetGroup(tg httpsd.TargetGroup) []discoverGroup {
+	groups := []discoverGroup{{Labels: tg.Labels, Targets: []string{}}}
+	index := map[string]int{"": 0}
+	for _, t := range tg.Targets {
+		key := labelSetKey(t.Labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, discoverGroup{Labels: httpsd.EffectiveLabels(tg.Labels, t.Labels), Targets: []string{}})
+		}
+		groups[i].Targets = append(groups[i].Targets, t.Addr)
+	}
+	if len(groups) > 1 && len(groups[0].Targets) == 0 {
+		groups = groups[1:]
+	}
+	return groups
+}
+
+// labelSetKey returns a key identifying a set of labels.
+func labelSetKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(strconv.Quote(k))
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	return b.String()
+}
+
+// notModified answers 304 if the request's If-None-Match holds etag.
+func notModified(w http.ResponseWriter, req *http.Request, etag string) bool {
+	for _, t := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip-compressed responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// discoverTargets returns the targets of a discover response.
+func discoverTargets(t *testing.T, body []byte) []string {
+	t.Helper()
+	var groups []struct {
+		Targets []string `json:"targets"`
+	}
+	if err := json.Unmarshal(body, &groups); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	targets := []string{}
+	for _, g := range groups {
+		targets = append(targets, g.Targets...)
+	}
+	return targets
+}
+
+func TestDiscoverNotModified(t *testing.T) {
+	store := newMemStore(t)
+	store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}})
+	router := newTestRouter(NewSDServer(store, nil, ForwardProxy))
+
+	rec := serve(router, "GET", "/api/v1/discover", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag != `"1"` {
+		t.Fatalf("discover = %d with ETag %s, want 200 with \"1\"", rec.Code, etag)
+	}
+	rec = serve(router, "GET", "/api/v1/discover", "", "If-None-Match", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+		t.Errorf("discover with If-None-Match %s = %d %q, want an empty 304", etag, rec.Code, rec.Body)
+	}
+	rec = serve(router, "GET", "/api/v1/discover", "", "If-None-Match", `W/"0", `+etag)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("discover with a list of ETags = %d, want 304", rec.Code)
+	}
+}
+
+func TestDiscoverInvalidatedByMutation(t *testing.T) {
+	store := newMemStore(t)
+	tg := store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "node-1:9100"}}})
+	router := newTestRouter(NewSDServer(store, nil, ForwardProxy))
+
+	rec := serve(router, "GET", "/api/v1/discover", "")
+	etag := rec.Header().Get("ETag")
+	if got := discoverTargets(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []string{"node-1:9100"}) {
+		t.Fatalf("targets = %v", got)
+	}
+
+	tg.Targets = []httpsd.Target{{Addr: "node-2:9100"}}
+	if _, err := store.UpdateTargetGroup(context.Background(), tg, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(router, "GET", "/api/v1/discover", "", "If-None-Match", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("discover after a mutation = %d with ETag %s, want 200 with a new ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+	if got := discoverTargets(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []string{"node-1:9100", "node-2:9100"}) {
+		t.Errorf("targets after a mutation = %v, want the new target", got)
+	}
+}
+
+func TestDiscoverGzip(t *testing.T) {
+	store := newMemStore(t)
+	store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}})
+	router := newTestRouter(NewSDServer(store, nil, ForwardProxy))
+
+	plain := serve(router, "GET", "/api/v1/discover", "")
+	if enc := plain.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding without Accept-Encoding = %q, want none", enc)
+	}
+	if got := discoverTargets(t, plain.Body.Bytes()); len(got) != 1 {
+		t.Errorf("targets = %v", got)
+	}
+	if rec := serve(router, "GET", "/api/v1/discover", "", "Accept-Encoding", "gzip;q=0, identity"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding with gzip;q=0 = %q, want none", rec.Header().Get("Content-Encoding"))
+	}
+
+	rec := serve(router, "GET", "/api/v1/discover", "", "Accept-Encoding", "deflate, gzip")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding with Accept-Encoding gzip = %q, want gzip", enc)
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", vary)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("gunzipped body = %q, want %q", body, plain.Body)
+	}
+}
+
+func TestDiscoverGrantsNotShared(t *testing.T) {
+	store := newMemStore(t)
+	one := store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}})
+	two := store.createGroup(t, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.2:9100"}}})
+	sd := NewSDServer(store, nil, ForwardProxy)
+	sd.EnableAuth(AuthConfig{Tokens: store})
+	router := newTestRouter(sd)
+	all := store.createToken(t, httpsd.ScopeDiscover)
+	first := store.createToken(t, httpsd.ScopeRead, httpsd.Grant{Role: httpsd.RoleReader, GroupID: one.ID})
+	second := store.createToken(t, httpsd.ScopeRead, httpsd.Grant{Role: httpsd.RoleReader, GroupID: two.ID})
+
+	// each response would be cached if it could be shared
+	etags := map[string]bool{}
+	for _, tc := range []struct {
+		secret string
+		want   []string
+	}{
+		{all, []string{"10.0.0.1:9100", "10.0.0.2:9100"}},
+		{first, []string{"10.0.0.1:9100"}},
+		{second, []string{"10.0.0.2:9100"}},
+		{first, []string{"10.0.0.1:9100"}},
+		{all, []string{"10.0.0.1:9100", "10.0.0.2:9100"}},
+	} {
+		rec := serve(router, "GET", "/api/v1/discover", "", bearer(tc.secret)...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("discover with %s = %d %q", tc.secret, rec.Code, rec.Body)
+		}
+		if got := discoverTargets(t, rec.Body.Bytes()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("discover with %s = %v, want %v", tc.secret, got, tc.want)
+		}
+		etags[rec.Header().Get("ETag")] = true
+	}
+	if len(etags) != 3 {
+		t.Errorf("ETags = %v, want one per token view", etags)
+	}
+
+	// the ETag of the shared response does not validate a grant-scoped one
+	rec := serve(router, "GET", "/api/v1/discover", "", append(bearer(first), "If-None-Match", `"`+strconv.FormatUint(store.Revision(), 10)+`"`)...)
+	if rec.Code != http.StatusOK {
+		t.Errorf("discover with the shared ETag = %d, want 200", rec.Code)
+	}
+	if got := discoverTargets(t, rec.Body.Bytes()); !reflect.DeepEqual(got, []string{"10.0.0.1:9100"}) {
+		t.Errorf("discover with the shared ETag = %v, want only group %d", got, one.ID)
+	}
+}
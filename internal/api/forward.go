@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// ForwardMode selects how a follower handles a write request.
+type ForwardMode string
+
+const (
+	// ForwardProxy transparently proxies writes to the leader.
+	ForwardProxy ForwardMode = "proxy"
+	// ForwardRedirect answers writes with a 307 to the leader's URL.
+	ForwardRedirect ForwardMode = "redirect"
+)
+
+// ErrNotLeader is returned for requests only the leader can serve.
+var ErrNotLeader = errors.New("this node is not the leader")
+
+// forwardedHeader marks requests proxied by a follower, so that a node
+// which lost leadership in the meantime does not forward them again. It is
+// only trusted on requests coming from the host of a cluster member.
+const forwardedHeader = "X-Httpsd-Forwarded"
+
+// Cluster tells SDServer which node currently accepts writes and manages
+// the raft membership. Membership changes block until they are applied.
+type Cluster interface {
+	// IsLeader reports whether this node is the raft leader.
+	IsLeader() bool
+	// LeaderURL returns the API URL of the current leader, or "" if
+	// the leader or its URL is not known.
+	LeaderURL() string
+
+	Members() ([]Member, error)
+	AddMember(ctx context.Context, m Member) (*Member, error)
+	RemoveMember(ctx context.Context, id uint64) error
+	PromoteMember(ctx context.Context, id uint64) (*Member, error)
+	// Status reports the raft state of this node.
+	Status() (*ClusterStatus, error)
+
+	// Live returns an error if this node cannot serve anything, e.g. when
+	// its store cannot be read.
+	Live() error
+	// Ready returns an error telling why this node should not serve
+	// traffic yet, e.g. while it replays its WAL or has no leader.
+	Ready() error
+}
+
+// ParseForwardMode parses the forward mode of a deployment.
+func ParseForwardMode(s string) (ForwardMode, error) {
+	switch m := ForwardMode(s); m {
+	case ForwardProxy, ForwardRedirect:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown forward mode %q, want %s or %s", s, ForwardProxy, ForwardRedirect)
+}
+
+// ForwardToLeader wraps a write handler so that it only runs on the leader.
+// On a follower the request is proxied or redirected to the leader,
+// depending on the forward mode of the server.
+func (sd *SDServer) ForwardToLeader(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(forwardedHeader) != "" && sd.cluster != nil && !sd.fromMember(req) {
+			log.Printf("ignoring %s of %s, not a cluster member", forwardedHeader, req.RemoteAddr)
+			req.Header.Del(forwardedHeader)
+		}
+		if sd.cluster == nil || sd.cluster.IsLeader() || req.Header.Get(forwardedHeader) != "" {
+			// a follower can still propose, raft hands the proposal to the leader
+			h(w, req)
+			return
+		}
+		leader := sd.cluster.LeaderURL()
+		if leader == "" {
+			http.Error(w, "no leader available", http.StatusServiceUnavailable)
+			return
+		}
+		target, err := url.Parse(leader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch sd.forward {
+		case ForwardRedirect:
+			loc := *req.URL
+			loc.Scheme, loc.Host = target.Scheme, target.Host
+			http.Redirect(w, req, loc.String(), http.StatusTemporaryRedirect)
+		default:
+			log.Printf("forwarding %s %s to leader %s", req.Method, req.URL.Path, leader)
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = sd.ForwardTransport
+			proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+				http.Error(w, "forwarding to leader: "+err.Error(), http.StatusBadGateway)
+			}
+			req.Header.Set(forwardedHeader, "1")
+			proxy.ServeHTTP(w, req)
+		}
+	}
+}
+
+// fromMember reports whether req was sent from the host of the API or peer
+// URLs of a cluster member.
+func (sd *SDServer) fromMember(req *http.Request) bool {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	members, err := sd.cluster.Members()
+	if err != nil {
+		return false
+	}
+	for _, m := range members {
+		for _, u := range append([]string{m.APIURL}, m.PeerURLs...) {
+			parsed, err := url.Parse(u)
+			if err != nil || parsed.Hostname() == "" {
+				continue
+			}
+			addrs, err := net.LookupIP(parsed.Hostname())
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if addr.Equal(remoteIP) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// stubCluster is a Cluster of members of which this node is the leader or
+// a follower of the node with API URL leaderURL.
+type stubCluster struct {
+	leader    bool
+	leaderURL string
+	members   []Member
+}
+
+func (c *stubCluster) IsLeader() bool    { return c.leader }
+func (c *stubCluster) LeaderURL() string { return c.leaderURL }
+func (c *stubCluster) Members() ([]Member, error) {
+	return c.members, nil
+}
+func (c *stubCluster) AddMember(ctx context.Context, m Member) (*Member, error) {
+	return nil, errors.New("not implemented")
+}
+func (c *stubCluster) RemoveMember(ctx context.Context, id uint64) error {
+	return errors.New("not implemented")
+}
+func (c *stubCluster) PromoteMember(ctx context.Context, id uint64) (*Member, error) {
+	return nil, errors.New("not implemented")
+}
+func (c *stubCluster) Status() (*ClusterStatus, error) { return &ClusterStatus{}, nil }
+func (c *stubCluster) Live() error                     { return nil }
+func (c *stubCluster) Ready() error                    { return nil }
+
+// leaderHandler answers like the leader would, recording what it got.
+type leaderHandler struct {
+	calls     int32
+	forwarded string
+	uri       string
+	body      string
+}
+
+func (h *leaderHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&h.calls, 1)
+	h.forwarded = req.Header.Get(forwardedHeader)
+	h.uri = req.URL.RequestURI()
+	body, _ := ioutil.ReadAll(req.Body)
+	h.body = string(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"id": 7}`))
+}
+
+func TestForwardToLeaderProxy(t *testing.T) {
+	leader := &leaderHandler{}
+	srv := httptest.NewServer(leader)
+	defer srv.Close()
+	sd := NewSDServer(nil, &stubCluster{leaderURL: srv.URL}, ForwardProxy)
+	local := func(w http.ResponseWriter, req *http.Request) { t.Error("follower handled the write itself") }
+
+	rec := serve(sd.ForwardToLeader(local), "POST", "/api/v1/target/?consistency=stale", `{"labels": {}}`)
+	if rec.Code != http.StatusCreated || rec.Body.String() != `{"id": 7}` {
+		t.Errorf("proxied write = %d %q, want the leader's 201", rec.Code, rec.Body)
+	}
+	if leader.uri != "/api/v1/target/?consistency=stale" || leader.body != `{"labels": {}}` {
+		t.Errorf("leader got %s %q, want the original request", leader.uri, leader.body)
+	}
+	if leader.forwarded == "" {
+		t.Errorf("proxied request has no %s header", forwardedHeader)
+	}
+}
+
+func TestForwardToLeaderRedirect(t *testing.T) {
+	sd := NewSDServer(nil, &stubCluster{leaderURL: "https://10.0.0.1:8443"}, ForwardRedirect)
+	local := func(w http.ResponseWriter, req *http.Request) { t.Error("follower handled the write itself") }
+
+	rec := serve(sd.ForwardToLeader(local), "PUT", "http://10.0.0.2:8080/api/v1/target/3/?consistency=stale", `{}`)
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("redirected write = %d, want 307", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://10.0.0.1:8443/api/v1/target/3/?consistency=stale" {
+		t.Errorf("Location = %q, want the leader's URL with the path and query", loc)
+	}
+}
+
+func TestForwardToLeaderOneHop(t *testing.T) {
+	// a node that lost leadership gets a proxied request and believes the
+	// first node is the leader: it must handle it, not send it back
+	var handled int32
+	second := NewSDServer(nil, &stubCluster{leaderURL: "http://127.0.0.1:1", members: []Member{{ID: 1, APIURL: "http://127.0.0.1:2"}}}, ForwardProxy)
+	srv := httptest.NewServer(second.ForwardToLeader(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&handled, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	first := NewSDServer(nil, &stubCluster{leaderURL: srv.URL}, ForwardProxy)
+	local := func(w http.ResponseWriter, req *http.Request) { t.Error("first node handled the write itself") }
+
+	rec := serve(first.ForwardToLeader(local), "DELETE", "/api/v1/target/3/", "")
+	if rec.Code != http.StatusNoContent || atomic.LoadInt32(&handled) != 1 {
+		t.Errorf("forwarded write = %d, handled %d times, want 204 handled once by the second node", rec.Code, handled)
+	}
+}
+
+func TestForwardToLeaderNoLeader(t *testing.T) {
+	sd := NewSDServer(nil, &stubCluster{}, ForwardProxy)
+	rec := serve(sd.ForwardToLeader(func(w http.ResponseWriter, req *http.Request) {}), "POST", "/api/v1/target/", `{}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("write without a leader = %d, want 503", rec.Code)
+	}
+	sd = NewSDServer(nil, &stubCluster{leader: true}, ForwardProxy)
+	rec = serve(sd.ForwardToLeader(func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusNoContent) }), "POST", "/api/v1/target/", `{}`)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("write on the leader = %d, want it handled", rec.Code)
+	}
+}
+
+func TestForwardToLeaderUntrustedHeader(t *testing.T) {
+	leader := &leaderHandler{}
+	srv := httptest.NewServer(leader)
+	defer srv.Close()
+	// the request comes from 192.0.2.1, which is not a member
+	sd := NewSDServer(nil, &stubCluster{leaderURL: srv.URL, members: []Member{{ID: 1, APIURL: "http://127.0.0.1:8080"}}}, ForwardProxy)
+	local := func(w http.ResponseWriter, req *http.Request) { t.Error("follower handled a client write marked as forwarded") }
+
+	rec := serve(sd.ForwardToLeader(local), "POST", "/api/v1/target/", `{}`, forwardedHeader, "1")
+	if rec.Code != http.StatusCreated || atomic.LoadInt32(&leader.calls) != 1 {
+		t.Errorf("write marked as forwarded by a client = %d, leader called %d times, want it forwarded", rec.Code, leader.calls)
+	}
+}
@@ -1,8 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"log"
 	"mime"
@@ -11,21 +12,74 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/momirjalili/httpsd/internal/httpsd"
-	bolt "go.etcd.io/bbolt"
 )
 
+// Store is the target group store served by SDServer. Mutations block
+// until they are applied, e.g. once they are committed through raft, and
+// return the applied result.
+type Store interface {
+	// LinearizableRead blocks until reads reflect every write committed
+	// before the call.
+	LinearizableRead(ctx context.Context) error
+	// Revision returns a number that changes whenever a mutation is applied.
+	Revision() uint64
+	GetAllTargetGroups() ([]httpsd.TargetGroup, error)
+	GetTargetGroup(id uint64) (*httpsd.TargetGroup, error)
+	// FindByAddress returns the targets at a canonical address.
+	FindByAddress(addr string) ([]httpsd.AddrMatch, error)
+	// The target group mutations take the token the request was authorized
+	// with, they fail with ErrForbidden if it lost its role on a group by
+	// the time they are applied.
+	CreateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error)
+	UpdateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error)
+	DeleteTargetGroup(ctx context.Context, id uint64, auth *httpsd.Token) error
+	DeleteTarget(ctx context.Context, tgID uint64, tID uint64, auth *httpsd.Token) error
+	DeleteTargetAddr(ctx context.Context, tgID uint64, addr string, auth *httpsd.Token) error
+	// MoveTarget moves the target at addr between groups and returns its
+	// ID in the new group.
+	MoveTarget(ctx context.Context, fromID, toID uint64, addr string, auth *httpsd.Token) (uint64, error)
+	// RemoveAddr deletes the targets at addr from every group and returns
+	// the IDs of those groups. It fails with ErrAddrGroupsChanged if the
+	// address is in groups other than groupIDs when it is applied.
+	RemoveAddr(ctx context.Context, addr string, groupIDs []uint64, auth *httpsd.Token) ([]uint64, error)
+	DeleteLabel(ctx context.Context, tgID uint64, labelKey string, auth *httpsd.Token) error
+
+	GetJobs() ([]httpsd.Job, error)
+	GetJob(name string) (*httpsd.Job, error)
+	PutJob(ctx context.Context, j *httpsd.Job) (*httpsd.Job, error)
+	DeleteJob(ctx context.Context, name string) error
+
+	GetLeases() ([]httpsd.Lease, error)
+	GetLease(id uint64) (*httpsd.Lease, error)
+	GrantLease(ctx context.Context, ttl int64) (*httpsd.Lease, error)
+	// RevokeLease revokes a lease and deletes its targets. It fails with
+	// ErrForbidden if auth is not editor of their groups when it is applied.
+	RevokeLease(ctx context.Context, id uint64, auth *httpsd.Token) error
+	// KeepAlive renews a lease. Only the leader tracks expiry, so it fails
+	// with ErrNotLeader on followers.
+	KeepAlive(id uint64) (*httpsd.Lease, error)
+}
+
 type SDServer struct {
-	store *httpsd.TargetStore
+	store   Store
+	cluster Cluster
+	forward ForwardMode
+	auth    *AuthConfig // nil unless EnableAuth was called
+	cache   discoverCache
+
+	// ForwardTransport proxies writes to the leader, http.DefaultTransport
+	// if nil. Set it when the leader's API is served over TLS.
+	ForwardTransport http.RoundTripper
 }
 
 type ErrorResponse struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Errors  []httpsd.Violation `json:"errors,omitempty"`
 }
 
-func NewSDServer(db *bolt.DB) *SDServer {
-	store := httpsd.New(db)
-	return &SDServer{store: store}
+func NewSDServer(store Store, cluster Cluster, forward ForwardMode) *SDServer {
+	return &SDServer{store: store, cluster: cluster, forward: forward}
 }
 
 // renderJSON renders 'v' as JSON and writes it as a response into w.
@@ -39,39 +93,83 @@ func renderJSON(w http.ResponseWriter, v interface{}) {
 	w.Write(js)
 }
 
-func (sd *SDServer) DiscoverHandler(w http.ResponseWriter, req *http.Request) {
-	allTGs, err := sd.store.GetAllTargetGroups()
-	if err != nil {
-		fmt.Printf("error getting all targets")
+// storeError writes the HTTP error matching an error returned by the store
+// or by validation.
+func storeError(w http.ResponseWriter, err error) {
+	var verr *httpsd.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Code: http.StatusBadRequest, Message: "invalid target group", Errors: verr.Violations})
+	case errors.Is(err, httpsd.ErrTargetGroupNotFound), errors.Is(err, httpsd.ErrTargetNotFound),
+		errors.Is(err, httpsd.ErrTokenNotFound), errors.Is(err, httpsd.ErrJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, httpsd.ErrTargetExists), errors.Is(err, httpsd.ErrAddrGroupsChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, httpsd.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, httpsd.ErrLeaseNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mergeLabels returns a copy of labels with the updates applied, as the
+// store applies them, for checking the labels a group ends up with.
+func mergeLabels(labels, updates map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(labels)+len(updates))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range updates {
+		merged[k] = v
 	}
-	resp := []map[string]interface{}{}
+	return merged
+}
 
-	for _, tg := range allTGs {
-		targets := []string{}
-		t := map[string]interface{}{"labels": tg.Labels}
-		for _, instance := range tg.Targets {
-			targets = append(targets, instance.Addr)
+// readConsistency honours the consistency query parameter of a read.
+// "stale", the default, serves the local state as is; "linearizable" first
+// waits until the local state has caught up with the cluster's commit index.
+// It reports whether the read may proceed and writes the error otherwise.
+func (sd *SDServer) readConsistency(w http.ResponseWriter, req *http.Request) bool {
+	switch req.URL.Query().Get("consistency") {
+	case "", "stale":
+		return true
+	case "linearizable":
+		if err := sd.store.LinearizableRead(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return false
 		}
-		t["targets"] = targets
-		resp = append(resp, t)
+		return true
+	default:
+		http.Error(w, "consistency must be linearizable or stale", http.StatusBadRequest)
+		return false
 	}
-	renderJSON(w, resp)
 }
 
 // GET /api/v1/target/    return targets list
 func (sd *SDServer) GetAllTargetGroupsHandler(w http.ResponseWriter, req *http.Request) {
-	fmt.Printf("getting all target groups\n")
+	if !sd.readConsistency(w, req) {
+		return
+	}
 	allTGs, err := sd.store.GetAllTargetGroups()
 	if err != nil {
-		fmt.Printf("error getting all targets")
+		log.Printf("listing target groups failed (%v)", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	renderJSON(w, allTGs)
+	renderJSON(w, readableGroups(req, allTGs))
 }
 
 //createTargetGroupHandler POST /api/v1/target/     creates a new target group
 func (sd *SDServer) CreateTargetGroupHandler(w http.ResponseWriter, req *http.Request) {
 	log.Printf("handling target group create at %s\n", req.URL.Path)
-	fmt.Printf("body is %s \n", req.Body)
 	// Enforce a JSON Content-Type.
 	contentType := req.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(contentType)
@@ -84,20 +182,27 @@ func (sd *SDServer) CreateTargetGroupHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 	dec := json.NewDecoder(req.Body)
+	dec.UseNumber() // label values are converted to strings as written
 	var tg httpsd.TargetGroup
 	if err := dec.Decode(&tg); err != nil {
-		fmt.Printf("error decoding %s \n", err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	log.Printf("decoded target group  is %v", tg)
-	err = sd.store.CreateTargetGroup(&tg)
-
+	if err := tg.Normalize(); err != nil {
+		storeError(w, err)
+		return
+	}
+	if !authorizeLabels(w, req, 0, tg.Labels, httpsd.RoleAdmin) {
+		return
+	}
+	created, err := sd.store.CreateTargetGroup(req.Context(), &tg, commandAuth(req))
 	if err != nil {
-		fmt.Printf("error on storing targetgroup %s\n ", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("storing target group failed (%v)", err)
+		storeError(w, err)
 		return
 	}
+	renderJSON(w, created)
 }
 
 func (sd *SDServer) GetTargetGroupHandler(w http.ResponseWriter, req *http.Request) {
@@ -105,13 +210,19 @@ func (sd *SDServer) GetTargetGroupHandler(w http.ResponseWriter, req *http.Reque
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
+	}
+	if !sd.readConsistency(w, req) {
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
-		fmt.Printf("returning %s\n", err.Error())
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleReader) {
+		return
+	}
 	renderJSON(w, tg)
 }
 
@@ -120,6 +231,7 @@ func (sd *SDServer) PutTargetGroupHandler(w http.ResponseWriter, req *http.Reque
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
@@ -127,20 +239,31 @@ func (sd *SDServer) PutTargetGroupHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 	dec := json.NewDecoder(req.Body)
+	dec.UseNumber()
 	tat := &httpsd.TargetGroup{ID: tg.ID}
 	if err := dec.Decode(tat); err != nil {
-		fmt.Printf("error decoding %s \n", err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	fmt.Printf("sent data is tat: %+v \n", tat)
+	if tat.DefaultPort == 0 {
+		// addresses without a port get the group's default port
+		tat.DefaultPort = tg.DefaultPort
+	}
+	if err := tat.Normalize(); err != nil {
+		storeError(w, err)
+		return
+	}
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) ||
+		!authorizeLabels(w, req, tg.ID, mergeLabels(tg.Labels, tat.Labels), httpsd.RoleEditor) {
+		return
+	}
 
-	err = sd.store.UpdateTargetGroup(tat)
+	updated, err := sd.store.UpdateTargetGroup(req.Context(), tat, commandAuth(req))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		storeError(w, err)
 		return
 	}
-	renderJSON(w, tat)
+	renderJSON(w, updated)
 }
 
 // PATCH  /api/v1/target/<target_group_id>/label/<label_key>     # updates a label in a target group
@@ -149,6 +272,7 @@ func (sd *SDServer) PatchTargetGroupLabelHandler(w http.ResponseWriter, req *htt
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
@@ -160,19 +284,27 @@ func (sd *SDServer) PatchTargetGroupLabelHandler(w http.ResponseWriter, req *htt
 	label := mux.Vars(req)["label_key"]
 	_, ok := tg.Labels[label]
 	if !ok {
-		fmt.Printf("label not exists\n")
 		http.Error(w, "label does not exists.", http.StatusNotFound)
+		return
 	}
 	v, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	patch := &httpsd.TargetGroup{ID: tg.ID, Labels: map[string]interface{}{label: string(v)}}
+	if err := patch.Normalize(); err != nil {
+		storeError(w, err)
+		return
+	}
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) ||
+		!authorizeLabels(w, req, tg.ID, mergeLabels(tg.Labels, map[string]interface{}{label: string(v)}), httpsd.RoleEditor) {
+		return
+	}
 
-	err = sd.store.UpdateTargetGroup(
-		&httpsd.TargetGroup{ID: tg.ID, Labels: map[string]interface{}{label: string(v)}})
+	_, err = sd.store.UpdateTargetGroup(req.Context(), patch, commandAuth(req))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		storeError(w, err)
 		return
 	}
 	tg.Labels[label] = string(v)
@@ -185,6 +317,7 @@ func (sd *SDServer) DeleteTargetGroupLabelHandler(w http.ResponseWriter, req *ht
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
@@ -194,11 +327,18 @@ func (sd *SDServer) DeleteTargetGroupLabelHandler(w http.ResponseWriter, req *ht
 
 	// updating labels
 	label := mux.Vars(req)["label_key"]
-	err = sd.store.DeleteLabel(tg.ID, label)
+	remaining := mergeLabels(tg.Labels, nil)
+	delete(remaining, label)
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) ||
+		!authorizeLabels(w, req, tg.ID, remaining, httpsd.RoleEditor) {
+		return
+	}
+	err = sd.store.DeleteLabel(req.Context(), tg.ID, label, commandAuth(req))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		storeError(w, err)
 		return
 	}
+	delete(tg.Labels, label)
 	renderJSON(w, tg)
 }
 
@@ -208,18 +348,26 @@ func (sd *SDServer) DeleteTargetGroupTargetHandler(w http.ResponseWriter, req *h
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) {
+		return
+	}
 	server_id, err := strconv.ParseUint(mux.Vars(req)["instance_id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
-	sd.store.DeleteTarget(tg.ID, server_id)
-
+	if err := sd.store.DeleteTarget(req.Context(), tg.ID, server_id, commandAuth(req)); err != nil {
+		storeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // DELETE /api/v1/target/<target_group_id>  # deletes a target group in a target group
@@ -228,15 +376,19 @@ func (sd *SDServer) DeleteTargetGroupHandler(w http.ResponseWriter, req *http.Re
 	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
 	}
 	tg, err := sd.store.GetTargetGroup(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	if err != nil {
-		http.Error(w, "you need to provide id", http.StatusBadRequest)
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleAdmin) {
+		return
 	}
-	sd.store.DeleteTargetGroup(tg.ID)
-
+	if err := sd.store.DeleteTargetGroup(req.Context(), tg.ID, commandAuth(req)); err != nil {
+		storeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetAllTargetGroupsStoreError(t *testing.T) {
+	store := newMemStore(t)
+	router := newTestRouter(NewSDServer(store, nil, ForwardProxy))
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(router, "GET", "/api/v1/target/", ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("listing from a closed store = %d %q, want %d", rec.Code, rec.Body, http.StatusInternalServerError)
+	}
+}
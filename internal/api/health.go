@@ -0,0 +1,33 @@
+package api
+
+import (
+	"log"
+	"net/http"
+)
+
+// GET /healthz    reports whether the process is alive and its store can be read
+func (sd *SDServer) HealthzHandler(w http.ResponseWriter, req *http.Request) {
+	if sd.cluster != nil {
+		if err := sd.cluster.Live(); err != nil {
+			log.Printf("healthz: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz    reports whether the node is in sync with the cluster and should get traffic
+func (sd *SDServer) ReadyzHandler(w http.ResponseWriter, req *http.Request) {
+	if sd.cluster != nil {
+		if err := sd.cluster.Live(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err := sd.cluster.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// authorizeJobs reports whether the request may manage jobs, and writes the
+// error otherwise. Jobs select across all target groups, so tokens limited
+// to some groups by grants may not change them.
+func authorizeJobs(w http.ResponseWriter, req *http.Request) bool {
+	if token := tokenFromContext(req.Context()); token != nil && len(token.Grants) > 0 {
+		http.Error(w, "token is limited to some target groups and cannot manage jobs", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// GET /api/v1/jobs    lists the discovery jobs
+func (sd *SDServer) ListJobsHandler(w http.ResponseWriter, req *http.Request) {
+	if !sd.readConsistency(w, req) {
+		return
+	}
+	jobs, err := sd.store.GetJobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderJSON(w, map[string][]httpsd.Job{"jobs": jobs})
+}
+
+// GET /api/v1/jobs/<job>    returns a discovery job
+func (sd *SDServer) GetJobHandler(w http.ResponseWriter, req *http.Request) {
+	if !sd.readConsistency(w, req) {
+		return
+	}
+	job, err := sd.store.GetJob(mux.Vars(req)["job"])
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	renderJSON(w, job)
+}
+
+// PUT /api/v1/jobs/<job>    creates or replaces a discovery job {"match": ..., "labels": {...}}
+func (sd *SDServer) PutJobHandler(w http.ResponseWriter, req *http.Request) {
+	if !authorizeJobs(w, req) {
+		return
+	}
+	var job httpsd.Job
+	if err := json.NewDecoder(req.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.Name = mux.Vars(req)["job"]
+	if err := job.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	put, err := sd.store.PutJob(req.Context(), &job)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("put job %s matching %q", put.Name, put.Match)
+	renderJSON(w, put)
+}
+
+// DELETE /api/v1/jobs/<job>    deletes a discovery job
+func (sd *SDServer) DeleteJobHandler(w http.ResponseWriter, req *http.Request) {
+	if !authorizeJobs(w, req) {
+		return
+	}
+	name := mux.Vars(req)["job"]
+	if err := sd.store.DeleteJob(req.Context(), name); err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("deleted job %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// leaseID parses the lease ID of the request, and writes the error if it
+// is invalid.
+func leaseID(w http.ResponseWriter, req *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(req)["lease_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide lease id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// GET /api/v1/leases    lists the leases
+func (sd *SDServer) ListLeasesHandler(w http.ResponseWriter, req *http.Request) {
+	if !sd.readConsistency(w, req) {
+		return
+	}
+	leases, err := sd.store.GetLeases()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readable := leases[:0]
+	for i := range leases {
+		ok, err := sd.readableLease(req, &leases[i])
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if ok {
+			readable = append(readable, leases[i])
+		}
+	}
+	renderJSON(w, map[string][]httpsd.Lease{"leases": readable})
+}
+
+// GET /api/v1/leases/<lease_id>    returns a lease and its targets
+func (sd *SDServer) GetLeaseHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := leaseID(w, req)
+	if !ok || !sd.readConsistency(w, req) {
+		return
+	}
+	lease, err := sd.store.GetLease(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if ok, err := sd.readableLease(req, lease); err != nil {
+		storeError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, httpsd.ErrLeaseNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	renderJSON(w, lease)
+}
+
+// readableLease drops the targets of a lease in groups the request may not
+// read, and reports whether the lease may be shown: leases whose targets are
+// all in such groups are hidden, like the groups.
+func (sd *SDServer) readableLease(req *http.Request, lease *httpsd.Lease) (bool, error) {
+	if tokenFromContext(req.Context()) == nil || len(lease.Targets) == 0 {
+		return true, nil
+	}
+	readable := lease.Targets[:0]
+	for _, lt := range lease.Targets {
+		tg, err := sd.store.GetTargetGroup(lt.GroupID)
+		if err == httpsd.ErrTargetGroupNotFound {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if groupRole(req, tg.ID, tg.Labels).Allows(httpsd.RoleReader) {
+			readable = append(readable, lt)
+		}
+	}
+	lease.Targets = readable
+	return len(readable) > 0, nil
+}
+
+// authorizeLease reports whether the request is editor of the groups of
+// every target of a lease, and writes the error otherwise. Renewing or
+// revoking a lease keeps or deletes the targets, which takes editing them.
+func (sd *SDServer) authorizeLease(w http.ResponseWriter, req *http.Request, lease *httpsd.Lease) bool {
+	for _, lt := range lease.Targets {
+		tg, err := sd.store.GetTargetGroup(lt.GroupID)
+		if err == httpsd.ErrTargetGroupNotFound {
+			continue
+		} else if err != nil {
+			storeError(w, err)
+			return false
+		}
+		if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) {
+			return false
+		}
+	}
+	return true
+}
+
+// POST /api/v1/leases    grants a lease {"ttl": 30}
+func (sd *SDServer) GrantLeaseHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		TTL int64 `json:"ttl"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.TTL <= 0 {
+		http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+		return
+	}
+	lease, err := sd.store.GrantLease(req.Context(), body.TTL)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("granted lease %d with a ttl of %ds", lease.ID, lease.TTL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(lease)
+}
+
+// POST /api/v1/leases/<lease_id>/keepalive    renews a lease for its TTL
+func (sd *SDServer) KeepAliveLeaseHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := leaseID(w, req)
+	if !ok {
+		return
+	}
+	lease, err := sd.store.GetLease(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if !sd.authorizeLease(w, req, lease) {
+		return
+	}
+	lease, err = sd.store.KeepAlive(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	renderJSON(w, lease)
+}
+
+// DELETE /api/v1/leases/<lease_id>    revokes a lease and deletes its targets
+func (sd *SDServer) RevokeLeaseHandler(w http.ResponseWriter, req *http.Request) {
+	id, ok := leaseID(w, req)
+	if !ok {
+		return
+	}
+	lease, err := sd.store.GetLease(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if !sd.authorizeLease(w, req, lease) {
+		return
+	}
+	// targets attached since are checked when the revoke is applied
+	if err := sd.store.RevokeLease(req.Context(), id, commandAuth(req)); err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("revoked lease %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpsd",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "httpsd",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "API request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	discoverSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "httpsd",
+		Subsystem: "discover",
+		Name:      "response_size_bytes",
+		Help:      "Size of the discover responses.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	})
+	discoverBuild = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "httpsd",
+		Subsystem: "discover",
+		Name:      "build_duration_seconds",
+		Help:      "Time to read the target groups and encode a discover response.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests)
+	prometheus.MustRegister(httpDuration)
+	prometheus.MustRegister(discoverSize)
+	prometheus.MustRegister(discoverBuild)
+}
+
+// statusRecorder remembers the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Instrument is a mux middleware counting requests and observing their
+// latency, labelled with the route's path template so that IDs in the path
+// do not blow up the number of series.
+func Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if tmpl, err := r.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(rec.code)).Inc()
+		httpDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	bolt "go.etcd.io/bbolt"
+)
+
+// memStore is a Store and TokenStore applying every mutation to a
+// TargetStore right away, as a single node does once it is committed.
+type memStore struct {
+	*httpsd.TargetStore
+
+	mu    sync.Mutex
+	index uint64
+}
+
+func newMemStore(t *testing.T) *memStore {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "httpsd.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := httpsd.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	return &memStore{TargetStore: ts}
+}
+
+func (s *memStore) apply(cmd *httpsd.Command) (*httpsd.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index++
+	return cmd, s.TargetStore.Apply(s.index, cmd)
+}
+
+func (s *memStore) LinearizableRead(ctx context.Context) error { return nil }
+
+func (s *memStore) Revision() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+func (s *memStore) CreateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpCreateTargetGroup, TargetGroup: tg, Auth: auth})
+	return cmd.TargetGroup, err
+}
+
+func (s *memStore) UpdateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpUpdateTargetGroup, TargetGroup: tg, Auth: auth})
+	return cmd.TargetGroup, err
+}
+
+func (s *memStore) DeleteTargetGroup(ctx context.Context, id uint64, auth *httpsd.Token) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteTargetGroup, GroupID: id, Auth: auth})
+	return err
+}
+
+func (s *memStore) DeleteTarget(ctx context.Context, tgID uint64, tID uint64, auth *httpsd.Token) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteTarget, GroupID: tgID, TargetID: tID, Auth: auth})
+	return err
+}
+
+func (s *memStore) DeleteTargetAddr(ctx context.Context, tgID uint64, addr string, auth *httpsd.Token) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteTargetAddr, GroupID: tgID, Addr: addr, Auth: auth})
+	return err
+}
+
+func (s *memStore) MoveTarget(ctx context.Context, fromID, toID uint64, addr string, auth *httpsd.Token) (uint64, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpMoveTarget, GroupID: fromID, ToGroupID: toID, Addr: addr, Auth: auth})
+	return cmd.TargetID, err
+}
+
+func (s *memStore) RemoveAddr(ctx context.Context, addr string, groupIDs []uint64, auth *httpsd.Token) ([]uint64, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpRemoveAddr, Addr: addr, GroupIDs: groupIDs, Auth: auth})
+	return cmd.GroupIDs, err
+}
+
+func (s *memStore) DeleteLabel(ctx context.Context, tgID uint64, labelKey string, auth *httpsd.Token) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteLabel, GroupID: tgID, LabelKey: labelKey, Auth: auth})
+	return err
+}
+
+func (s *memStore) PutJob(ctx context.Context, j *httpsd.Job) (*httpsd.Job, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpPutJob, Job: j})
+	return cmd.Job, err
+}
+
+func (s *memStore) DeleteJob(ctx context.Context, name string) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteJob, JobName: name})
+	return err
+}
+
+func (s *memStore) GrantLease(ctx context.Context, ttl int64) (*httpsd.Lease, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpGrantLease, Lease: &httpsd.Lease{TTL: ttl}})
+	return cmd.Lease, err
+}
+
+func (s *memStore) RevokeLease(ctx context.Context, id uint64, auth *httpsd.Token) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpRevokeLease, LeaseID: id, Auth: auth})
+	return err
+}
+
+func (s *memStore) KeepAlive(id uint64) (*httpsd.Lease, error) {
+	return s.GetLease(id)
+}
+
+func (s *memStore) CreateToken(ctx context.Context, t *httpsd.Token) (*httpsd.Token, error) {
+	cmd, err := s.apply(&httpsd.Command{Op: httpsd.OpCreateToken, Token: t})
+	return cmd.Token, err
+}
+
+func (s *memStore) DeleteToken(ctx context.Context, id uint64) error {
+	_, err := s.apply(&httpsd.Command{Op: httpsd.OpDeleteToken, TokenID: id})
+	return err
+}
+
+// createGroup stores a target group for a test.
+func (s *memStore) createGroup(t *testing.T, tg *httpsd.TargetGroup) *httpsd.TargetGroup {
+	t.Helper()
+	tg, err := s.CreateTargetGroup(context.Background(), tg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tg
+}
+
+// createToken stores a token for a test and returns its secret.
+func (s *memStore) createToken(t *testing.T, scope httpsd.Scope, grants ...httpsd.Grant) string {
+	t.Helper()
+	secret := fmt.Sprintf("%s-%d", scope, s.Revision()+1)
+	token := &httpsd.Token{Name: secret, Hash: httpsd.HashToken(secret), Scope: scope, Grants: grants}
+	if _, err := s.CreateToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// newTestRouter routes the API of sd as NewHttpSDServer in the raft
+// package does, for the handlers the tests use.
+func newTestRouter(sd *SDServer) *mux.Router {
+	router := mux.NewRouter()
+	router.StrictSlash(true)
+	leader := sd.ForwardToLeader
+	discover := func(h http.HandlerFunc) http.HandlerFunc { return sd.Authorize(httpsd.ScopeDiscover, h) }
+	read := func(h http.HandlerFunc) http.HandlerFunc { return sd.Authorize(httpsd.ScopeRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return sd.Authorize(httpsd.ScopeWrite, leader(h)) }
+
+	router.HandleFunc("/api/v1/target/", read(sd.GetAllTargetGroupsHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/target/", write(sd.CreateTargetGroupHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", read(sd.GetTargetGroupHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", write(sd.PutTargetGroupHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", write(sd.DeleteTargetGroupHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/discover", discover(sd.DiscoverHandler))
+	router.HandleFunc("/api/v1/discover/{job}", discover(sd.JobDiscoverHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/jobs/{job}", write(sd.PutJobHandler)).Methods("PUT")
+	return router
+}
+
+// serve sends a request with the given headers to h and returns the
+// recorded response.
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// bearer returns the Authorization header of a token secret.
+func bearer(secret string) []string {
+	return []string{"Authorization", "Bearer " + secret}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// addrMatch is a target found by address, with the discovery jobs that
+// select it.
+type addrMatch struct {
+	httpsd.AddrMatch
+	Jobs []string `json:"jobs"`
+}
+
+// GET /api/v1/targets?addr=<host:port>    the target groups and jobs an address is in
+func (sd *SDServer) FindTargetsHandler(w http.ResponseWriter, req *http.Request) {
+	addr, ok := queryAddr(w, req)
+	if !ok || !sd.readConsistency(w, req) {
+		return
+	}
+	found, err := sd.store.FindByAddress(addr)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	jobs, err := sd.store.GetJobs()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	matches := []addrMatch{}
+	for _, m := range found {
+		if !groupRole(req, m.GroupID, m.GroupLabels).Allows(httpsd.RoleReader) {
+			continue
+		}
+		match := addrMatch{AddrMatch: m, Jobs: []string{}}
+		for _, job := range jobs {
+			if sel, err := job.Selector(); err == nil && sel.Matches(m.Labels) {
+				match.Jobs = append(match.Jobs, job.Name)
+			}
+		}
+		matches = append(matches, match)
+	}
+	renderJSON(w, map[string]interface{}{"addr": addr, "targets": matches})
+}
+
+// queryAddr returns the canonical address of the addr parameter, and
+// writes the error if it is invalid.
+func queryAddr(w http.ResponseWriter, req *http.Request) (string, bool) {
+	addr, err := httpsd.CanonicalAddr(req.URL.Query().Get("addr"), 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return addr, true
+}
+
+// DELETE /api/v1/target/<target_group_id>/instance?addr=<host:port>    deletes a target by address
+func (sd *SDServer) DeleteTargetAddrHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
+	}
+	addr, ok := queryAddr(w, req)
+	if !ok {
+		return
+	}
+	tg, err := sd.store.GetTargetGroup(id)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) {
+		return
+	}
+	if err := sd.store.DeleteTargetAddr(req.Context(), tg.ID, addr, commandAuth(req)); err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("deleted %s from target group %d", addr, tg.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/v1/target/<target_group_id>/move    moves a target to another group {"addr": "host:port", "to": 2}
+func (sd *SDServer) MoveTargetHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "you need to provide id", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Addr string `json:"addr"`
+		To   uint64 `json:"to"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addr, err := httpsd.CanonicalAddr(body.Addr, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, groupID := range []uint64{id, body.To} {
+		tg, err := sd.store.GetTargetGroup(groupID)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if !authorizeGroup(w, req, tg.ID, tg.Labels, httpsd.RoleEditor) {
+			return
+		}
+	}
+	if _, err := sd.store.MoveTarget(req.Context(), id, body.To, addr, commandAuth(req)); err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("moved %s from target group %d to %d", addr, id, body.To)
+	to, err := sd.store.GetTargetGroup(body.To)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	renderJSON(w, to)
+}
+
+// DELETE /api/v1/targets?addr=<host:port>    deletes an address from every target group
+func (sd *SDServer) RemoveAddrHandler(w http.ResponseWriter, req *http.Request) {
+	addr, ok := queryAddr(w, req)
+	if !ok {
+		return
+	}
+	found, err := sd.store.FindByAddress(addr)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	authorized := make([]uint64, 0, len(found))
+	for _, m := range found {
+		if !groupRole(req, m.GroupID, m.GroupLabels).Allows(httpsd.RoleEditor) {
+			http.Error(w, "token is not editor of every target group with this address", http.StatusForbidden)
+			return
+		}
+		authorized = append(authorized, m.GroupID)
+	}
+	// the address is only removed from the groups checked here
+	groups, err := sd.store.RemoveAddr(req.Context(), addr, authorized, commandAuth(req))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	log.Printf("removed %s from target groups %v", addr, groups)
+	if groups == nil {
+		groups = []uint64{}
+	}
+	renderJSON(w, map[string]interface{}{"addr": addr, "group_ids": groups})
+}
@@ -0,0 +1,390 @@
+// Package config loads the configuration of the httpsd server from a YAML
+// file, HTTPSD_* environment variables and command-line flags, in
+// increasing order of precedence.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix prefixes the environment variable of every option, e.g. the
+// data-dir option is read from HTTPSD_DATA_DIR.
+const EnvPrefix = "HTTPSD_"
+
+// Config is the configuration of a httpsd node.
+type Config struct {
+	ID    int      `yaml:"id"`
+	Peers []string `yaml:"cluster"`
+	Join  bool     `yaml:"join"`
+
+	APIListen       string `yaml:"api-listen"`
+	AdvertiseAPIURL string `yaml:"advertise-api-url"`
+	RaftListen      string `yaml:"raft-listen"`
+	Forward         string `yaml:"forward"`
+
+	DataDir        string        `yaml:"data-dir"`
+	RaftStorage    string        `yaml:"raft-storage"` // wal or bolt
+	SnapshotCount  uint64        `yaml:"snapshot-count"`
+	TickInterval   time.Duration `yaml:"tick-interval"`
+	ElectionTicks  int           `yaml:"election-ticks"`
+	HeartbeatTicks int           `yaml:"heartbeat-ticks"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	// ReadyMaxLag is how many committed entries a node may not have applied
+	// yet while /readyz reports it ready.
+	ReadyMaxLag uint64 `yaml:"ready-max-lag"`
+
+	// The API is served over TLS when a certificate is set. The trusted CA
+	// verifies the leader when forwarding writes and, with client cert
+	// auth, the certificates API clients must present.
+	APICertFile       string `yaml:"api-cert-file"`
+	APIKeyFile        string `yaml:"api-key-file"`
+	APITrustedCAFile  string `yaml:"api-trusted-ca-file"`
+	APIClientCertAuth bool   `yaml:"api-client-cert-auth"`
+
+	// Raft peers use mutual TLS when a certificate is set.
+	PeerCertFile      string `yaml:"peer-cert-file"`
+	PeerKeyFile       string `yaml:"peer-key-file"`
+	PeerTrustedCAFile string `yaml:"peer-trusted-ca-file"`
+
+	// With auth enabled every request needs a bearer token. The admin
+	// token file holds a token that is not replicated, to bootstrap the
+	// replicated ones. DiscoverAuth is "anonymous" or "token".
+	AuthEnabled    bool   `yaml:"auth-enabled"`
+	AdminTokenFile string `yaml:"admin-token-file"`
+	DiscoverAuth   string `yaml:"discover-auth"`
+}
+
+// Default returns the configuration used for options that are not set.
+func Default() Config {
+	return Config{
+		ID:             1,
+		Peers:          []string{"http://127.0.0.1:9021"},
+		APIListen:      ":8080",
+		Forward:        "proxy",
+		RaftStorage:    "wal",
+		SnapshotCount:  10000,
+		TickInterval:   100 * time.Millisecond,
+		ElectionTicks:  10,
+		HeartbeatTicks: 1,
+
+		ShutdownTimeout: 10 * time.Second,
+		ReadyMaxLag:     100,
+
+		DiscoverAuth: "anonymous",
+	}
+}
+
+// option is a setting that can be given as a flag or environment variable.
+type option struct {
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// boolOptions are the options given as flags without a value, e.g. --join,
+// or with one, e.g. --join=false.
+var boolOptions = map[string]bool{
+	"join":                 true,
+	"api-client-cert-auth": true,
+	"auth-enabled":         true,
+}
+
+// funcValue is a flag.Value calling set, a boolean flag if isBool.
+type funcValue struct {
+	set    func(string) error
+	isBool bool
+}
+
+func (f funcValue) String() string     { return "" }
+func (f funcValue) Set(v string) error { return f.set(v) }
+func (f funcValue) IsBoolFlag() bool   { return f.isBool }
+
+var options = []option{
+	{"id", "node ID", func(c *Config, v string) (err error) {
+		c.ID, err = strconv.Atoi(v)
+		return
+	}},
+	{"cluster", "comma separated raft peer URLs", func(c *Config, v string) error {
+		c.Peers = strings.Split(v, ",")
+		return nil
+	}},
+	{"join", "join an existing cluster", func(c *Config, v string) (err error) {
+		c.Join, err = strconv.ParseBool(v)
+		return
+	}},
+	{"api-listen", "address the service discovery API listens on (default :8080)", func(c *Config, v string) error {
+		c.APIListen = v
+		return nil
+	}},
+	{"advertise-api-url", "API URL the other members forward writes to (default http://<api-listen>)", func(c *Config, v string) error {
+		c.AdvertiseAPIURL = v
+		return nil
+	}},
+	{"raft-listen", "address raft listens on (default the host of this node's peer URL)", func(c *Config, v string) error {
+		c.RaftListen = v
+		return nil
+	}},
+	{"forward", "how followers handle writes: proxy or redirect (default proxy)", func(c *Config, v string) error {
+		c.Forward = v
+		return nil
+	}},
+	{"data-dir", "directory of the WAL, snapshots and bolt store (default httpsd-<id>)", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"raft-storage", "where the raft log is kept: wal or bolt (default wal)", func(c *Config, v string) error {
+		c.RaftStorage = v
+		return nil
+	}},
+	{"snapshot-count", "applied entries between two raft snapshots (default 10000)", func(c *Config, v string) (err error) {
+		c.SnapshotCount, err = strconv.ParseUint(v, 10, 64)
+		return
+	}},
+	{"tick-interval", "duration of a raft tick (default 100ms)", func(c *Config, v string) (err error) {
+		c.TickInterval, err = time.ParseDuration(v)
+		return
+	}},
+	{"election-ticks", "ticks without leader contact before an election (default 10)", func(c *Config, v string) (err error) {
+		c.ElectionTicks, err = strconv.Atoi(v)
+		return
+	}},
+	{"heartbeat-ticks", "ticks between leader heartbeats (default 1)", func(c *Config, v string) (err error) {
+		c.HeartbeatTicks, err = strconv.Atoi(v)
+		return
+	}},
+	{"api-cert-file", "certificate of the API server, enables TLS", func(c *Config, v string) error {
+		c.APICertFile = v
+		return nil
+	}},
+	{"api-key-file", "key of the API server certificate", func(c *Config, v string) error {
+		c.APIKeyFile = v
+		return nil
+	}},
+	{"api-trusted-ca-file", "CA of the API certificates, the system roots if unset", func(c *Config, v string) error {
+		c.APITrustedCAFile = v
+		return nil
+	}},
+	{"api-client-cert-auth", "require API clients to present a certificate signed by api-trusted-ca-file", func(c *Config, v string) (err error) {
+		c.APIClientCertAuth, err = strconv.ParseBool(v)
+		return
+	}},
+	{"peer-cert-file", "certificate raft peers present to each other, enables mutual TLS", func(c *Config, v string) error {
+		c.PeerCertFile = v
+		return nil
+	}},
+	{"peer-key-file", "key of the peer certificate", func(c *Config, v string) error {
+		c.PeerKeyFile = v
+		return nil
+	}},
+	{"peer-trusted-ca-file", "CA that signed the peer certificates", func(c *Config, v string) error {
+		c.PeerTrustedCAFile = v
+		return nil
+	}},
+	{"auth-enabled", "require bearer tokens on the API", func(c *Config, v string) (err error) {
+		c.AuthEnabled, err = strconv.ParseBool(v)
+		return
+	}},
+	{"admin-token-file", "file holding an admin token to create the first API tokens with", func(c *Config, v string) error {
+		c.AdminTokenFile = v
+		return nil
+	}},
+	{"discover-auth", "anonymous or token, whether discover needs a token when auth is enabled (default anonymous)", func(c *Config, v string) error {
+		c.DiscoverAuth = v
+		return nil
+	}},
+	{"shutdown-timeout", "time allowed to drain requests and hand over leadership on SIGINT or SIGTERM (default 10s)", func(c *Config, v string) (err error) {
+		c.ShutdownTimeout, err = time.ParseDuration(v)
+		return
+	}},
+	{"ready-max-lag", "committed entries a node may be behind on while /readyz reports it ready (default 100)", func(c *Config, v string) (err error) {
+		c.ReadyMaxLag, err = strconv.ParseUint(v, 10, 64)
+		return
+	}},
+}
+
+// Load builds the configuration from the config file named by --config or
+// HTTPSD_CONFIG, the environment and the command-line arguments.
+func Load(name string, args []string, output io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	configFile := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path of a YAML config file")
+	flags := map[string]string{}
+	for _, o := range options {
+		o := o
+		fs.Var(funcValue{isBool: boolOptions[o.name], set: func(v string) error {
+			// validate now so that the error names the flag
+			if err := o.set(&Config{}, v); err != nil {
+				return err
+			}
+			flags[o.name] = v
+			return nil
+		}}, o.name, o.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range options {
+		env := EnvPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok {
+			if err := o.set(&cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %v", v, env, err)
+			}
+		}
+	}
+	for _, o := range options {
+		if v, ok := flags[o.name]; ok {
+			o.set(&cfg, v)
+		}
+	}
+
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// setDefaults fills in the options whose default depends on other options.
+func (c *Config) setDefaults() {
+	if c.DataDir == "" {
+		c.DataDir = fmt.Sprintf("httpsd-%d", c.ID)
+	}
+	if c.AdvertiseAPIURL == "" {
+		host, port, err := net.SplitHostPort(c.APIListen)
+		if err != nil {
+			return
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		scheme := "http"
+		if c.APICertFile != "" {
+			scheme = "https"
+		}
+		c.AdvertiseAPIURL = scheme + "://" + net.JoinHostPort(host, port)
+	}
+}
+
+// Validate reports the first invalid option of c.
+func (c *Config) Validate() error {
+	switch {
+	case c.AdvertiseAPIURL == "":
+		return fmt.Errorf("invalid api-listen %q", c.APIListen)
+	case c.ID < 1:
+		return errors.New("id must be at least 1")
+	case len(c.Peers) == 0:
+		return errors.New("cluster must list at least one peer")
+	case c.ID > len(c.Peers) && c.RaftListen == "":
+		return fmt.Errorf("id %d has no peer URL in cluster, set raft-listen", c.ID)
+	case c.RaftStorage != "wal" && c.RaftStorage != "bolt":
+		return fmt.Errorf("raft-storage must be wal or bolt, not %q", c.RaftStorage)
+	case c.TickInterval <= 0:
+		return errors.New("tick-interval must be positive")
+	case c.HeartbeatTicks < 1:
+		return errors.New("heartbeat-ticks must be at least 1")
+	case c.ElectionTicks <= c.HeartbeatTicks:
+		return errors.New("election-ticks must be greater than heartbeat-ticks")
+	case c.ShutdownTimeout <= 0:
+		return errors.New("shutdown-timeout must be positive")
+	case (c.APICertFile == "") != (c.APIKeyFile == ""):
+		return errors.New("api-cert-file and api-key-file must be set together")
+	case c.APITrustedCAFile != "" && c.APICertFile == "":
+		return errors.New("api-trusted-ca-file requires api-cert-file")
+	case c.APIClientCertAuth && c.APITrustedCAFile == "":
+		return errors.New("api-client-cert-auth requires api-trusted-ca-file")
+	case c.DiscoverAuth != "anonymous" && c.DiscoverAuth != "token":
+		return fmt.Errorf("discover-auth must be anonymous or token, not %q", c.DiscoverAuth)
+	case c.AdminTokenFile != "" && !c.AuthEnabled:
+		return errors.New("admin-token-file requires auth-enabled")
+	}
+	return c.validatePeerTLS()
+}
+
+func (c *Config) validatePeerTLS() error {
+	peerTLS := c.PeerCertFile != ""
+	if peerTLS != (c.PeerKeyFile != "") || peerTLS != (c.PeerTrustedCAFile != "") {
+		return errors.New("peer-cert-file, peer-key-file and peer-trusted-ca-file must be set together")
+	}
+	for _, peer := range c.Peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer URL %q: %v", peer, err)
+		}
+		if peerTLS && u.Scheme != "https" {
+			return fmt.Errorf("peer URL %q must use https with peer TLS", peer)
+		}
+		if !peerTLS && u.Scheme != "http" {
+			return fmt.Errorf("peer URL %q must use http without peer TLS", peer)
+		}
+	}
+	return nil
+}
+
+// APITLSInfo is the TLS configuration of the API, empty if TLS is disabled.
+func (c *Config) APITLSInfo() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:       c.APICertFile,
+		KeyFile:        c.APIKeyFile,
+		TrustedCAFile:  c.APITrustedCAFile,
+		ClientCertAuth: c.APIClientCertAuth,
+	}
+}
+
+// PeerTLSInfo is the mutual TLS configuration of the raft transport, empty
+// if TLS is disabled.
+func (c *Config) PeerTLSInfo() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:       c.PeerCertFile,
+		KeyFile:        c.PeerKeyFile,
+		TrustedCAFile:  c.PeerTrustedCAFile,
+		ClientCertAuth: c.PeerCertFile != "",
+	}
+}
+
+// WALDir is the directory of the raft write-ahead log.
+func (c *Config) WALDir() string { return filepath.Join(c.DataDir, "wal") }
+
+// SnapDir is the directory of the raft snapshots.
+func (c *Config) SnapDir() string { return filepath.Join(c.DataDir, "snap") }
+
+// RaftDBPath is the path of the raft log with the bolt raft storage.
+func (c *Config) RaftDBPath() string { return filepath.Join(c.DataDir, "raft.db") }
+
+// DBPath is the path of the bolt target store.
+func (c *Config) DBPath() string { return filepath.Join(c.DataDir, "httpsd.db") }
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "httpsd.yaml")
+	yml := `
+id: 2
+cluster: [http://10.0.0.1:2380, http://10.0.0.2:2380]
+api-listen: 10.0.0.2:8080
+data-dir: /var/lib/httpsd
+raft-storage: bolt
+snapshot-count: 500
+tick-interval: 50ms
+`
+	if err := ioutil.WriteFile(path, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HTTPSD_SNAPSHOT_COUNT", "1000")
+	os.Setenv("HTTPSD_DATA_DIR", "/srv/httpsd")
+	defer os.Unsetenv("HTTPSD_SNAPSHOT_COUNT")
+	defer os.Unsetenv("HTTPSD_DATA_DIR")
+
+	cfg, err := Load("httpsd", []string{"--config", path, "--data-dir", "/tmp/httpsd", "--election-ticks", "20"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		ID:              2,
+		Peers:           []string{"http://10.0.0.1:2380", "http://10.0.0.2:2380"},
+		APIListen:       "10.0.0.2:8080",
+		AdvertiseAPIURL: "http://10.0.0.2:8080",
+		Forward:         "proxy",
+		DataDir:         "/tmp/httpsd",
+		RaftStorage:     "bolt",
+		SnapshotCount:   1000,
+		TickInterval:    50 * time.Millisecond,
+		ElectionTicks:   20,
+		HeartbeatTicks:  1,
+		ShutdownTimeout: 10 * time.Second,
+		ReadyMaxLag:     100,
+		DiscoverAuth:    "anonymous",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := [][]string{
+		{"--id", "x"},
+		{"--id", "0"},
+		{"--id", "3", "--cluster", "http://127.0.0.1:2380"},
+		{"--election-ticks", "1"},
+		{"--tick-interval", "0s"},
+		{"--shutdown-timeout", "-1s"},
+		{"--api-listen", "8080"},
+		{"--config", "does-not-exist.yaml"},
+		{"--api-cert-file", "api.crt"},
+		{"--api-cert-file", "api.crt", "--api-key-file", "api.key", "--api-client-cert-auth"},
+		{"--peer-cert-file", "peer.crt", "--peer-key-file", "peer.key", "--peer-trusted-ca-file", "ca.crt"},
+		{"--cluster", "https://127.0.0.1:2380"},
+		{"--discover-auth", "basic"},
+		{"--admin-token-file", "admin.token"},
+		{"--raft-storage", "memory"},
+	}
+	for i, args := range tests {
+		if _, err := Load("httpsd", args, ioutil.Discard); err == nil {
+			t.Errorf("#%d: Load(%q) succeeded, want error", i, args)
+		}
+	}
+
+	// a bare boolean flag is set, the error must be about the missing CA
+	args := tests[9]
+	if _, err := Load("httpsd", args, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "requires api-trusted-ca-file") {
+		t.Errorf("Load(%q) = %v, want api-trusted-ca-file error", args, err)
+	}
+}
+
+func TestLoadBoolFlags(t *testing.T) {
+	tests := []struct {
+		args  []string
+		check func(c *Config) bool
+	}{
+		{
+			[]string{"--join", "--cluster", "http://127.0.0.1:2380,http://127.0.0.1:2381", "--id", "2"},
+			func(c *Config) bool { return c.Join && c.ID == 2 && len(c.Peers) == 2 },
+		},
+		{
+			[]string{"--join=false", "--id", "1"},
+			func(c *Config) bool { return !c.Join && c.ID == 1 },
+		},
+		{
+			[]string{"--auth-enabled", "--admin-token-file", "admin.token"},
+			func(c *Config) bool { return c.AuthEnabled && c.AdminTokenFile == "admin.token" },
+		},
+		{
+			[]string{"--api-cert-file", "api.crt", "--api-key-file", "api.key", "--api-trusted-ca-file", "ca.crt", "--api-client-cert-auth"},
+			func(c *Config) bool { return c.APIClientCertAuth && c.APITrustedCAFile == "ca.crt" },
+		},
+	}
+	for i, tc := range tests {
+		cfg, err := Load("httpsd", tc.args, ioutil.Discard)
+		if err != nil {
+			t.Errorf("#%d: Load(%q) = %v", i, tc.args, err)
+			continue
+		}
+		if !tc.check(cfg) {
+			t.Errorf("#%d: Load(%q) = %+v", i, tc.args, cfg)
+		}
+	}
+}
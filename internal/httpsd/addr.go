@@ -0,0 +1,68 @@
+package httpsd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CanonicalAddr parses a target address and returns it as host:port, with
+// the host lowercased, IPs in their canonical form and IPv6 bracketed, and
+// the port without leading zeros. Addresses without a port get defaultPort,
+// and are invalid if it is 0.
+func CanonicalAddr(addr string, defaultPort int) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.Contains(addr, "://") {
+		return "", fmt.Errorf("address %q must be host:port, without a scheme", addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// no port: a host, a bracketed IPv6 or a bare IPv6
+		host, port = addr, ""
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		} else if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", fmt.Errorf("address %q must be host:port", addr)
+		}
+	}
+	host, err = canonicalHost(host)
+	if err != nil {
+		return "", fmt.Errorf("address %q: %v", addr, err)
+	}
+	if port == "" {
+		if defaultPort == 0 {
+			return "", fmt.Errorf("address %q has no port and there is no default port", addr)
+		}
+		port = strconv.Itoa(defaultPort)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return "", fmt.Errorf("address %q: invalid port %q", addr, port)
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(p, 10)), nil
+}
+
+// canonicalHost returns the canonical form of an IP or host name.
+func canonicalHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	ip, zone := host, ""
+	if i := strings.LastIndexByte(host, '%'); i > 0 && strings.Contains(host, ":") {
+		ip, zone = host[:i], host[i:]
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String() + zone, nil
+	}
+	host = strings.ToLower(host)
+	for i, c := range host {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_':
+		case (c == '-' || c == '.') && i > 0 && i < len(host)-1:
+		default:
+			return "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return host, nil
+}
@@ -0,0 +1,61 @@
+package httpsd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr        string
+		defaultPort int
+		want        string
+	}{
+		{"10.0.0.1:9100", 0, "10.0.0.1:9100"},
+		{"10.0.0.1:09100", 0, "10.0.0.1:9100"},
+		{" Node-A.Example.com:9100 ", 0, "node-a.example.com:9100"},
+		{"node-a", 9100, "node-a:9100"},
+		{"[2001:DB8::1]:9100", 0, "[2001:db8::1]:9100"},
+		{"2001:db8:0::1", 9100, "[2001:db8::1]:9100"},
+		{"[2001:db8::1]", 9100, "[2001:db8::1]:9100"},
+		{"[fe80::1%eth0]:9100", 0, "[fe80::1%eth0]:9100"},
+	} {
+		got, err := CanonicalAddr(tc.addr, tc.defaultPort)
+		if err != nil || got != tc.want {
+			t.Errorf("CanonicalAddr(%q, %d) = %q, %v, want %q", tc.addr, tc.defaultPort, got, err, tc.want)
+		}
+	}
+	for _, addr := range []string{
+		"node-a",
+		"http://node-a:9100",
+		"node-a:9100/metrics",
+		"node-a:http",
+		"node-a:0",
+		"node-a:65536",
+		"%!s(MISSING):9100",
+		":9100",
+		"-node:9100",
+		"2001:db8::1:9100:x",
+	} {
+		if got, err := CanonicalAddr(addr, 0); err == nil {
+			t.Errorf("CanonicalAddr(%q) = %q, want error", addr, got)
+		}
+	}
+}
+
+func TestTargetGroupNormalizeAddrs(t *testing.T) {
+	tg := &TargetGroup{DefaultPort: 9100, Targets: []Target{{Addr: "Node-A"}, {Addr: "10.0.0.1:09100"}}}
+	if err := tg.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if tg.Targets[0].Addr != "node-a:9100" || tg.Targets[1].Addr != "10.0.0.1:9100" {
+		t.Errorf("targets = %+v, want canonical addresses", tg.Targets)
+	}
+
+	tg = &TargetGroup{Targets: []Target{{Addr: "10.0.0.1:9100"}, {Addr: "10.0.0.1:09100"}, {Addr: "10.0.0.2"}}}
+	var verr *ValidationError
+	if err := tg.Normalize(); !errors.As(err, &verr) || len(verr.Violations) != 2 ||
+		verr.Violations[0].Field != "targets[1].addr" || verr.Violations[1].Field != "targets[2].addr" {
+		t.Errorf("Normalize() = %v, want a duplicate and a missing port", err)
+	}
+}
@@ -0,0 +1,77 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Op identifies the TargetStore mutation carried by a Command.
+type Op string
+
+const (
+	OpCreateTargetGroup Op = "CreateTargetGroup"
+	OpUpdateTargetGroup Op = "UpdateTargetGroup"
+	OpDeleteTargetGroup Op = "DeleteTargetGroup"
+	OpDeleteTarget      Op = "DeleteTarget"
+	OpDeleteLabel       Op = "DeleteLabel"
+	OpPublishMember     Op = "PublishMember"
+	OpRemoveMember      Op = "RemoveMember"
+	OpCreateToken       Op = "CreateToken"
+	OpDeleteToken       Op = "DeleteToken"
+	OpPutJob            Op = "PutJob"
+	OpDeleteJob         Op = "DeleteJob"
+	OpGrantLease        Op = "GrantLease"
+	OpRevokeLease       Op = "RevokeLease"
+	OpDeleteTargetAddr  Op = "DeleteTargetAddr"
+	OpMoveTarget        Op = "MoveTarget"
+	OpRemoveAddr        Op = "RemoveAddr"
+)
+
+// Command is a TargetStore mutation as it travels through the raft log.
+// Only the fields relevant to Op are set.
+type Command struct {
+	RequestID   uint64       `json:"request_id"`
+	Op          Op           `json:"op"`
+	TargetGroup *TargetGroup `json:"target_group,omitempty"`
+	GroupID     uint64       `json:"group_id,omitempty"`
+	TargetID    uint64       `json:"target_id,omitempty"`
+	LabelKey    string       `json:"label_key,omitempty"`
+	Member      *Member      `json:"member,omitempty"`
+	Token       *Token       `json:"token,omitempty"`
+	TokenID     uint64       `json:"token_id,omitempty"`
+	Job         *Job         `json:"job,omitempty"`
+	JobName     string       `json:"job_name,omitempty"`
+	Lease       *Lease       `json:"lease,omitempty"`
+	LeaseID     uint64       `json:"lease_id,omitempty"`
+	Addr        string       `json:"addr,omitempty"`
+	ToGroupID   uint64       `json:"to_group_id,omitempty"`
+	// GroupIDs are the groups RemoveAddr may remove the address from, those
+	// the request was authorized on, and the ones it was removed from once
+	// it is applied.
+	GroupIDs []uint64 `json:"group_ids,omitempty"`
+	// Auth is the token the request was authorized with, without its hash.
+	// Commands on target groups check its roles again when applied, against
+	// the groups as they are then. Nil if the request was not authenticated.
+	Auth *Token `json:"auth,omitempty"`
+}
+
+//EncodeCommand serializes a command for proposing it on the raft log
+func EncodeCommand(cmd *Command) (string, error) {
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+//DecodeCommand parses a command read from the raft log
+func DecodeCommand(data string) (*Command, error) {
+	var cmd Command
+	if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+		return nil, err
+	}
+	if cmd.Op == "" {
+		return nil, fmt.Errorf("command without op")
+	}
+	return &cmd, nil
+}
@@ -0,0 +1,43 @@
+package httpsd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommandRoundTrip(t *testing.T) {
+	auth := &Token{ID: 3, Name: "ci", Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, GroupID: 1}, {Role: RoleReader, Selector: map[string]string{"team": "a"}}}, CreatedAt: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	cmds := []*Command{
+		{RequestID: 1, Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Labels: map[string]interface{}{"job": "node"}, Targets: []Target{{Addr: "10.0.0.1:9100", LeaseID: 2, Labels: map[string]string{"rack": "r1"}}}}},
+		{RequestID: 2, Op: OpDeleteTarget, GroupID: 1, TargetID: 4},
+		{RequestID: 3, Op: OpDeleteLabel, GroupID: 1, LabelKey: "job"},
+		{RequestID: 4, Op: OpPublishMember, Member: &Member{ID: 2, APIURL: "http://10.0.0.2:8080"}},
+		{RequestID: 5, Op: OpCreateToken, Token: &Token{Name: "ci", Hash: HashToken("secret"), Scope: ScopeRead}},
+		{RequestID: 6, Op: OpPutJob, Job: &Job{Name: "node", Match: "team=a", Labels: map[string]string{"env": "prod"}}},
+		{RequestID: 7, Op: OpGrantLease, Lease: &Lease{TTL: 30}},
+		{RequestID: 8, Op: OpMoveTarget, GroupID: 1, ToGroupID: 2, Addr: "10.0.0.1:9100", Auth: auth},
+		{RequestID: 9, Op: OpRemoveAddr, Addr: "10.0.0.1:9100", GroupIDs: []uint64{1, 2}, Auth: auth},
+	}
+	for _, cmd := range cmds {
+		data, err := EncodeCommand(cmd)
+		if err != nil {
+			t.Fatalf("encoding %s: %v", cmd.Op, err)
+		}
+		got, err := DecodeCommand(data)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, cmd) {
+			t.Errorf("%s round trip = %+v, want %+v", cmd.Op, got, cmd)
+		}
+	}
+}
+
+func TestDecodeCommandInvalid(t *testing.T) {
+	for _, data := range []string{"", "{", `{"request_id": 1}`} {
+		if cmd, err := DecodeCommand(data); err == nil {
+			t.Errorf("DecodeCommand(%q) = %+v, want an error", data, cmd)
+		}
+	}
+}
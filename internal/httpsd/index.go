@@ -0,0 +1,289 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The targets of a group are stored by ID in its "target" bucket, the
+// primary records, and indexed by address in its "addr" bucket. The root
+// "AddrIndex" bucket maps every address to the IDs of the groups that have
+// it, as a JSON array. The indexes are only changed through putTarget and
+// removeTarget, in the transaction of the command changing the records.
+
+// indexVersion is the layout of the target buckets and indexes. Stores of
+// an older layout, or restored from an older snapshot, are reindexed.
+const indexVersion = 2
+
+//targetAddrBucket returns the address index of a target group
+func targetAddrBucket(tgiBkt *bolt.Bucket) (*bolt.Bucket, error) {
+	return tgiBkt.CreateBucketIfNotExists([]byte("addr"))
+}
+
+//targetByAddr returns the ID of the target of a group with address addr
+func targetByAddr(tgiBkt *bolt.Bucket, addr string) (uint64, bool) {
+	bkt := tgiBkt.Bucket([]byte("addr"))
+	if bkt == nil {
+		return 0, false
+	}
+	v := bkt.Get([]byte(addr))
+	if v == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(string(v), 10, 64)
+	return id, err == nil
+}
+
+//putTarget stores t in group groupID and indexes its address
+func (ts *TargetStore) putTarget(tx *bolt.Tx, tgiBkt *bolt.Bucket, groupID uint64, t Target) error {
+	tBkt := tgiBkt.Bucket([]byte("target"))
+	key := []byte(strconv.FormatUint(t.ID, 10))
+	if v := tBkt.Get(key); v != nil {
+		prev, err := decodeTarget(t.ID, v)
+		if err != nil {
+			return err
+		}
+		if prev.Addr != t.Addr {
+			if err := ts.unindexAddr(tx, tgiBkt, groupID, prev.Addr); err != nil {
+				return err
+			}
+		}
+	}
+	v, err := encodeTarget(t)
+	if err != nil {
+		return err
+	}
+	if err := tBkt.Put(key, v); err != nil {
+		return err
+	}
+	addrBkt, err := targetAddrBucket(tgiBkt)
+	if err != nil {
+		return err
+	}
+	if err := addrBkt.Put([]byte(t.Addr), key); err != nil {
+		return err
+	}
+	groups, err := ts.addrGroups(tx, t.Addr)
+	if err != nil {
+		return err
+	}
+	return ts.putAddrGroups(tx, t.Addr, addUint64(groups, groupID))
+}
+
+//removeTarget deletes target id of group groupID and its index entries,
+//returns false if there is no such target
+func (ts *TargetStore) removeTarget(tx *bolt.Tx, tgiBkt *bolt.Bucket, groupID, id uint64) (bool, error) {
+	tBkt := tgiBkt.Bucket([]byte("target"))
+	key := []byte(strconv.FormatUint(id, 10))
+	v := tBkt.Get(key)
+	if v == nil {
+		return false, nil
+	}
+	t, err := decodeTarget(id, v)
+	if err != nil {
+		return false, err
+	}
+	if err := ts.detachLease(tx, groupID, id); err != nil {
+		return false, err
+	}
+	if err := ts.unindexAddr(tx, tgiBkt, groupID, t.Addr); err != nil {
+		return false, err
+	}
+	return true, tBkt.Delete(key)
+}
+
+//unindexAddr removes addr from the indexes of group groupID
+func (ts *TargetStore) unindexAddr(tx *bolt.Tx, tgiBkt *bolt.Bucket, groupID uint64, addr string) error {
+	if bkt := tgiBkt.Bucket([]byte("addr")); bkt != nil {
+		if err := bkt.Delete([]byte(addr)); err != nil {
+			return err
+		}
+	}
+	groups, err := ts.addrGroups(tx, addr)
+	if err != nil {
+		return err
+	}
+	return ts.putAddrGroups(tx, addr, removeUint64(groups, groupID))
+}
+
+//addrGroups returns the sorted IDs of the groups with a target at addr
+func (ts *TargetStore) addrGroups(tx *bolt.Tx, addr string) ([]uint64, error) {
+	bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("AddrIndex"))
+	if bkt == nil {
+		return nil, nil
+	}
+	v := bkt.Get([]byte(addr))
+	if v == nil {
+		return nil, nil
+	}
+	var groups []uint64
+	err := json.Unmarshal(v, &groups)
+	return groups, err
+}
+
+func (ts *TargetStore) putAddrGroups(tx *bolt.Tx, addr string, groups []uint64) error {
+	bkt, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("AddrIndex"))
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return bkt.Delete([]byte(addr))
+	}
+	buf, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(addr), buf)
+}
+
+func addUint64(ids []uint64, id uint64) []uint64 {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeUint64(ids []uint64, id uint64) []uint64 {
+	kept := ids[:0]
+	for _, v := range ids {
+		if v != id {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+//migrate brings the layout of the store up to indexVersion
+func (ts *TargetStore) migrate(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(ts.rootBucket))
+	if v, _ := strconv.Atoi(string(root.Get([]byte("indexVersion")))); v >= indexVersion {
+		return nil
+	}
+	if err := ts.reindex(tx); err != nil {
+		return err
+	}
+	return root.Put([]byte("indexVersion"), []byte(strconv.Itoa(indexVersion)))
+}
+
+//reindex rebuilds the address indexes from the primary records. Address
+//keys that older versions kept in the target buckets, stale ones included,
+//are dropped.
+func (ts *TargetStore) reindex(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(ts.rootBucket))
+	if root.Bucket([]byte("AddrIndex")) != nil {
+		if err := root.DeleteBucket([]byte("AddrIndex")); err != nil {
+			return err
+		}
+	}
+	tgBkt := root.Bucket([]byte("TargetGroup"))
+	if tgBkt == nil {
+		return nil
+	}
+	// collect the groups first, buckets must not change while iterated
+	var groupIDs []uint64
+	tgBkt.ForEach(func(k, v []byte) error {
+		if id, err := strconv.ParseUint(string(k), 10, 64); err == nil && v == nil {
+			groupIDs = append(groupIDs, id)
+		}
+		return nil
+	})
+	for _, groupID := range groupIDs {
+		tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(groupID, 10)))
+		if tgiBkt.Bucket([]byte("addr")) != nil {
+			if err := tgiBkt.DeleteBucket([]byte("addr")); err != nil {
+				return err
+			}
+		}
+		tBkt, err := tgiBkt.CreateBucketIfNotExists([]byte("target"))
+		if err != nil {
+			return err
+		}
+		var targets []Target
+		var stale [][]byte
+		err = tBkt.ForEach(func(k, v []byte) error {
+			id, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				stale = append(stale, append([]byte(nil), k...))
+				return nil
+			}
+			t, err := decodeTarget(id, v)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := tBkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, t := range targets {
+			if err := ts.putTarget(tx, tgiBkt, groupID, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddrMatch is a target found by its address.
+type AddrMatch struct {
+	GroupID  uint64 `json:"group_id"`
+	TargetID uint64 `json:"target_id"`
+	// Labels are the labels of the target as discovered, those of its
+	// group with its own on top.
+	Labels      map[string]interface{} `json:"labels"`
+	GroupLabels map[string]interface{} `json:"group_labels"`
+}
+
+//FindByAddress returns the targets at address addr, in the order of their
+//groups, looked up in the address indexes
+func (ts *TargetStore) FindByAddress(addr string) ([]AddrMatch, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	matches := []AddrMatch{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		groups, err := ts.addrGroups(tx, addr)
+		if err != nil {
+			return err
+		}
+		for _, groupID := range groups {
+			tgiBkt, err := ts.targetGroupBucket(tx, groupID)
+			if err != nil {
+				return err
+			}
+			id, ok := targetByAddr(tgiBkt, addr)
+			if !ok {
+				return fmt.Errorf("address %s indexed in target group %d but not in its targets", addr, groupID)
+			}
+			t, err := decodeTarget(id, tgiBkt.Bucket([]byte("target")).Get([]byte(strconv.FormatUint(id, 10))))
+			if err != nil {
+				return err
+			}
+			var groupLabels map[string]interface{}
+			json.Unmarshal(tgiBkt.Get([]byte("label")), &groupLabels)
+			matches = append(matches, AddrMatch{
+				GroupID:     groupID,
+				TargetID:    id,
+				Labels:      EffectiveLabels(groupLabels, t.Labels),
+				GroupLabels: groupLabels,
+			})
+		}
+		return nil
+	})
+	return matches, err
+}
@@ -0,0 +1,118 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Job is a named view of the target groups for one Prometheus job: the
+// groups matching its selector, with its labels added to theirs.
+type Job struct {
+	Name string `json:"name"`
+	// Match is a label selector as parsed by ParseSelector.
+	Match string `json:"match"`
+	// Labels are set on every group of the job, replacing their own.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ErrJobNotFound is returned when a job name does not exist.
+var ErrJobNotFound = errors.New("no such job")
+
+var jobNameRE = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Validate reports what is wrong with a job.
+func (j *Job) Validate() error {
+	if !jobNameRE.MatchString(j.Name) {
+		return fmt.Errorf("job name %q must only have letters, digits, '_', '.' and '-'", j.Name)
+	}
+	if _, err := ParseSelector(j.Match); err != nil {
+		return err
+	}
+	for k, v := range j.Labels {
+		if reason := checkLabelName(k); reason != "" {
+			return fmt.Errorf("invalid label name %q: %s", k, reason)
+		}
+		if reason := checkLabelValue(v); reason != "" {
+			return fmt.Errorf("invalid value of label %q: %s", k, reason)
+		}
+	}
+	return nil
+}
+
+// Selector returns the parsed selector of the job.
+func (j *Job) Selector() (Selector, error) {
+	return ParseSelector(j.Match)
+}
+
+//GetJob returns the job named name
+func (ts *TargetStore) GetJob(name string) (*Job, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var j *Job
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Job"))
+		if bkt == nil {
+			return nil
+		}
+		if v := bkt.Get([]byte(name)); v != nil {
+			j = &Job{}
+			return json.Unmarshal(v, j)
+		}
+		return nil
+	})
+	if err == nil && j == nil {
+		err = ErrJobNotFound
+	}
+	return j, err
+}
+
+//GetJobs returns all jobs sorted by name
+func (ts *TargetStore) GetJobs() ([]Job, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	jobs := []Job{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Job"))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+//putJob creates a job or replaces the job with the same name
+func (ts *TargetStore) putJob(tx *bolt.Tx, j *Job) error {
+	bkt, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("Job"))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(j.Name), buf)
+}
+
+//deleteJob deletes a job, returns ErrJobNotFound if it doesn't exist
+func (ts *TargetStore) deleteJob(tx *bolt.Tx, name string) error {
+	bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Job"))
+	if bkt == nil || bkt.Get([]byte(name)) == nil {
+		return ErrJobNotFound
+	}
+	return bkt.Delete([]byte(name))
+}
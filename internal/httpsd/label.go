@@ -0,0 +1,160 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// reservedLabels are the double underscore labels Prometheus reads from
+// service discovery. The others are reserved, e.g. __address__ which is
+// set from the target address.
+var reservedLabels = map[string]bool{
+	"__metrics_path__":    true,
+	"__scheme__":          true,
+	"__scrape_interval__": true,
+	"__scrape_timeout__":  true,
+}
+
+// Violation is a reason a write cannot be stored, at the field it is about,
+// e.g. "labels.env" or "targets[1].labels.rack".
+type Violation struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists every violation found in a write.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		reasons = append(reasons, v.Field+": "+v.Reason)
+	}
+	return "invalid target group: " + strings.Join(reasons, "; ")
+}
+
+// checkLabelName returns why name is not a label name Prometheus accepts
+// from service discovery, or "".
+func checkLabelName(name string) string {
+	switch {
+	case !labelNameRE.MatchString(name):
+		return "label names must match [a-zA-Z_][a-zA-Z0-9_]*"
+	case strings.HasPrefix(name, "__") && !reservedLabels[name] &&
+		!strings.HasPrefix(name, "__meta_") && !strings.HasPrefix(name, "__param_"):
+		return "label names starting with __ are reserved"
+	}
+	return ""
+}
+
+// checkLabelValue returns why value is not a label value, or "".
+func checkLabelValue(value string) string {
+	if !utf8.ValidString(value) {
+		return "label values must be valid UTF-8"
+	}
+	return ""
+}
+
+// labelValue converts a decoded JSON label value to a string. Numbers and
+// booleans are converted, other values are rejected.
+func labelValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// Normalize checks the labels of the group and of its targets against the
+// Prometheus data model, converting number and boolean values to strings in
+// place, and canonicalises the target addresses with CanonicalAddr and the
+// group's default port. It returns a *ValidationError listing every
+// violation.
+func (tg *TargetGroup) Normalize() error {
+	var violations []Violation
+	if tg.DefaultPort < 0 || tg.DefaultPort > 65535 {
+		violations = append(violations, Violation{Field: "default_port", Reason: "ports must be between 1 and 65535"})
+	}
+	seen := map[string]int{}
+	for i, t := range tg.Targets {
+		field := fmt.Sprintf("targets[%d].addr", i)
+		addr, err := CanonicalAddr(t.Addr, tg.DefaultPort)
+		if err != nil {
+			violations = append(violations, Violation{Field: field, Reason: err.Error()})
+			continue
+		}
+		if j, ok := seen[addr]; ok {
+			violations = append(violations, Violation{Field: field, Reason: fmt.Sprintf("%s is also targets[%d]", addr, j)})
+		}
+		seen[addr] = i
+		tg.Targets[i].Addr = addr
+	}
+	for name, v := range tg.Labels {
+		field := "labels." + name
+		if reason := checkLabelName(name); reason != "" {
+			violations = append(violations, Violation{Field: field, Reason: reason})
+		}
+		value, ok := labelValue(v)
+		if !ok {
+			violations = append(violations, Violation{Field: field, Reason: fmt.Sprintf("label values must be strings, not %s", jsonType(v))})
+			continue
+		}
+		if reason := checkLabelValue(value); reason != "" {
+			violations = append(violations, Violation{Field: field, Reason: reason})
+		}
+		tg.Labels[name] = value
+	}
+	for i, t := range tg.Targets {
+		for name, value := range t.Labels {
+			field := fmt.Sprintf("targets[%d].labels.%s", i, name)
+			if reason := checkLabelName(name); reason != "" {
+				violations = append(violations, Violation{Field: field, Reason: reason})
+			}
+			if reason := checkLabelValue(value); reason != "" {
+				violations = append(violations, Violation{Field: field, Reason: reason})
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+	return &ValidationError{Violations: violations}
+}
+
+// EffectiveLabels returns the labels of a target as discovered: the labels
+// of its group with its own on top.
+func EffectiveLabels(group map[string]interface{}, target map[string]string) map[string]interface{} {
+	labels := make(map[string]interface{}, len(group)+len(target))
+	for k, v := range group {
+		labels[k] = v
+	}
+	for k, v := range target {
+		labels[k] = v
+	}
+	return labels
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,62 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTargetGroupNormalize(t *testing.T) {
+	tg := &TargetGroup{
+		Labels: map[string]interface{}{
+			"env":              "prod",
+			"port":             json.Number("9100"),
+			"ratio":            0.5,
+			"canary":           true,
+			"__metrics_path__": "/probe",
+			"__param_module":   "http_2xx",
+		},
+		Targets: []Target{{Addr: "node-a:9100", Labels: map[string]string{"rack": "r1"}}},
+	}
+	if err := tg.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"env":              "prod",
+		"port":             "9100",
+		"ratio":            "0.5",
+		"canary":           "true",
+		"__metrics_path__": "/probe",
+		"__param_module":   "http_2xx",
+	}
+	if !reflect.DeepEqual(tg.Labels, want) {
+		t.Errorf("labels = %v, want %v", tg.Labels, want)
+	}
+
+	tg = &TargetGroup{
+		Labels: map[string]interface{}{
+			"my-label":    "x",
+			"nested":      map[string]interface{}{"a": "b"},
+			"__address__": "10.0.0.1:80",
+			"1st":         nil,
+		},
+		Targets: []Target{
+			{Addr: "node-a:9100"},
+			{Addr: "node-b:9100", Labels: map[string]string{"rack": "\xff"}},
+		},
+	}
+	err := tg.Normalize()
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("err = %v, want a *ValidationError", err)
+	}
+	var fields []string
+	for _, v := range verr.Violations {
+		fields = append(fields, v.Field)
+	}
+	wantFields := []string{"labels.1st", "labels.1st", "labels.__address__", "labels.my-label", "labels.nested", "targets[1].labels.rack"}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("violations = %+v, want fields %v", verr.Violations, wantFields)
+	}
+}
@@ -0,0 +1,217 @@
+package httpsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Lease keeps the targets attached to it registered for as long as it is
+// kept alive. It expires TTL seconds after it was granted or last kept
+// alive, and the targets are deleted when it is revoked.
+type Lease struct {
+	ID      uint64        `json:"id"`
+	TTL     int64         `json:"ttl"`
+	Targets []LeaseTarget `json:"targets"`
+}
+
+// LeaseTarget is a target attached to a lease.
+type LeaseTarget struct {
+	GroupID  uint64 `json:"group_id"`
+	TargetID uint64 `json:"target_id"`
+}
+
+// ErrLeaseNotFound is returned when a lease ID does not exist.
+var ErrLeaseNotFound = errors.New("no such lease")
+
+// TTLDuration returns the TTL of the lease.
+func (l *Lease) TTLDuration() time.Duration {
+	return time.Duration(l.TTL) * time.Second
+}
+
+func leaseTargetKey(groupID, targetID uint64) []byte {
+	return []byte(strconv.FormatUint(groupID, 10) + "/" + strconv.FormatUint(targetID, 10))
+}
+
+//GetLease returns the lease with ID id
+func (ts *TargetStore) GetLease(id uint64) (*Lease, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var l *Lease
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		var err error
+		l, err = ts.lease(tx, id)
+		return err
+	})
+	return l, err
+}
+
+//GetLeases returns all leases
+func (ts *TargetStore) GetLeases() ([]Lease, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	leases := []Lease{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Lease"))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			var l Lease
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			leases = append(leases, l)
+			return nil
+		})
+	})
+	return leases, err
+}
+
+func (ts *TargetStore) lease(tx *bolt.Tx, id uint64) (*Lease, error) {
+	bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Lease"))
+	if bkt == nil {
+		return nil, ErrLeaseNotFound
+	}
+	v := bkt.Get([]byte(strconv.FormatUint(id, 10)))
+	if v == nil {
+		return nil, ErrLeaseNotFound
+	}
+	var l Lease
+	if err := json.Unmarshal(v, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (ts *TargetStore) putLease(tx *bolt.Tx, l *Lease) error {
+	bkt, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("Lease"))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(strconv.FormatUint(l.ID, 10)), buf)
+}
+
+//grantLease stores a new lease and sets its ID
+func (ts *TargetStore) grantLease(tx *bolt.Tx, l *Lease) error {
+	if l.TTL <= 0 {
+		return fmt.Errorf("lease TTL must be positive")
+	}
+	bkt, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("Lease"))
+	if err != nil {
+		return err
+	}
+	if l.ID, err = bkt.NextSequence(); err != nil {
+		return err
+	}
+	l.Targets = []LeaseTarget{}
+	return ts.putLease(tx, l)
+}
+
+//attachLease attaches a target to a lease, detaching it from the lease it
+//was attached to, returns ErrLeaseNotFound if the lease doesn't exist
+func (ts *TargetStore) attachLease(tx *bolt.Tx, leaseID, groupID, targetID uint64) error {
+	if err := ts.detachLease(tx, groupID, targetID); err != nil {
+		return err
+	}
+	l, err := ts.lease(tx, leaseID)
+	if err != nil {
+		return err
+	}
+	idx, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("LeaseTarget"))
+	if err != nil {
+		return err
+	}
+	key := leaseTargetKey(groupID, targetID)
+	l.Targets = append(l.Targets, LeaseTarget{GroupID: groupID, TargetID: targetID})
+	if err := ts.putLease(tx, l); err != nil {
+		return err
+	}
+	return idx.Put(key, []byte(strconv.FormatUint(leaseID, 10)))
+}
+
+//detachLease detaches a target from the lease it is attached to, if any
+func (ts *TargetStore) detachLease(tx *bolt.Tx, groupID, targetID uint64) error {
+	idx := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("LeaseTarget"))
+	if idx == nil {
+		return nil
+	}
+	key := leaseTargetKey(groupID, targetID)
+	v := idx.Get(key)
+	if v == nil {
+		return nil
+	}
+	leaseID, _ := strconv.ParseUint(string(v), 10, 64)
+	if l, err := ts.lease(tx, leaseID); err == nil {
+		l.Targets = removeLeaseTarget(l.Targets, groupID, targetID)
+		if err := ts.putLease(tx, l); err != nil {
+			return err
+		}
+	}
+	return idx.Delete(key)
+}
+
+func removeLeaseTarget(targets []LeaseTarget, groupID, targetID uint64) []LeaseTarget {
+	kept := targets[:0]
+	for _, t := range targets {
+		if t.GroupID != groupID || t.TargetID != targetID {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+//revokeLease deletes a lease along with the targets attached to it,
+//returns ErrLeaseNotFound if it doesn't exist and ErrForbidden if auth is
+//not editor of the group of one of them
+func (ts *TargetStore) revokeLease(tx *bolt.Tx, id uint64, auth *Token) error {
+	l, err := ts.lease(tx, id)
+	if err != nil {
+		return err
+	}
+	root := tx.Bucket([]byte(ts.rootBucket))
+	idx := root.Bucket([]byte("LeaseTarget"))
+	for _, lt := range l.Targets {
+		if idx != nil {
+			if err := idx.Delete(leaseTargetKey(lt.GroupID, lt.TargetID)); err != nil {
+				return err
+			}
+		}
+		tgiBkt, err := ts.targetGroupBucket(tx, lt.GroupID)
+		if err == ErrTargetGroupNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := checkRole(tgiBkt, lt.GroupID, auth, RoleEditor); err != nil {
+			return err
+		}
+		if _, err := ts.removeTarget(tx, tgiBkt, lt.GroupID, lt.TargetID); err != nil {
+			return err
+		}
+	}
+	return root.Bucket([]byte("Lease")).Delete([]byte(strconv.FormatUint(id, 10)))
+}
+
+//fillTargetLeases sets the lease of the targets of tg attached to one
+func (ts *TargetStore) fillTargetLeases(tx *bolt.Tx, tg *TargetGroup) {
+	idx := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("LeaseTarget"))
+	if idx == nil {
+		return
+	}
+	for i, t := range tg.Targets {
+		if v := idx.Get(leaseTargetKey(tg.ID, t.ID)); v != nil {
+			tg.Targets[i].LeaseID, _ = strconv.ParseUint(string(v), 10, 64)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package httpsd
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var boltTxDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "httpsd",
+	Subsystem: "bolt",
+	Name:      "tx_duration_seconds",
+	Help:      "Duration of the target store's bolt transactions, by read or write.",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+}, []string{"tx"})
+
+func init() {
+	prometheus.MustRegister(boltTxDuration)
+}
+
+//observeTx records a bolt transaction of the given kind started at start
+func observeTx(kind string, start time.Time) {
+	boltTxDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// storeCollector exports the size of a target store at scrape time.
+type storeCollector struct {
+	ts      *TargetStore
+	groups  *prometheus.Desc
+	targets *prometheus.Desc
+}
+
+// NewCollector returns a prometheus collector exporting the number of
+// target groups and targets in ts.
+func NewCollector(ts *TargetStore) prometheus.Collector {
+	return &storeCollector{
+		ts:      ts,
+		groups:  prometheus.NewDesc("httpsd_target_groups", "Number of target groups.", nil, nil),
+		targets: prometheus.NewDesc("httpsd_targets", "Number of targets in all target groups.", nil, nil),
+	}
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.groups
+	ch <- c.targets
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	tgs, err := c.ts.GetAllTargetGroups()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.groups, err)
+		return
+	}
+	targets := 0
+	for _, tg := range tgs {
+		targets += len(tg.Targets)
+	}
+	ch <- prometheus.MustNewConstMetric(c.groups, prometheus.GaugeValue, float64(len(tgs)))
+	ch <- prometheus.MustNewConstMetric(c.targets, prometheus.GaugeValue, float64(targets))
+}
@@ -0,0 +1,103 @@
+package httpsd
+
+import "fmt"
+
+// Role is what a token may do with a target group. Roles are ordered, each
+// one grants everything the previous ones do: reader < editor < admin.
+type Role string
+
+const (
+	// RoleNone grants nothing, the group is hidden.
+	RoleNone Role = ""
+	// RoleReader grants reading the group and seeing it in lists.
+	RoleReader Role = "reader"
+	// RoleEditor grants changing the group's targets and labels.
+	RoleEditor Role = "editor"
+	// RoleAdmin grants creating and deleting groups.
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{RoleReader: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool { return roleLevels[r] > 0 }
+
+// Allows reports whether role r may do what requires required.
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleLevels[r] >= roleLevels[required]
+}
+
+// groupRole is the role a scope grants on every target group, and the most
+// a token with that scope is granted on any group.
+func (s Scope) groupRole() Role {
+	switch s {
+	case ScopeDiscover, ScopeRead:
+		return RoleReader
+	case ScopeWrite, ScopeAdmin:
+		return RoleAdmin
+	}
+	return RoleNone
+}
+
+// Grant gives a role on the target groups it selects: the group with
+// GroupID if set, and the groups whose labels match every Selector label.
+// A grant with neither selects all groups.
+type Grant struct {
+	Role     Role              `json:"role"`
+	GroupID  uint64            `json:"group_id,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// Validate reports what is wrong with a grant.
+func (g Grant) Validate() error {
+	if !g.Role.Valid() {
+		return fmt.Errorf("grant role must be reader, editor or admin, not %q", g.Role)
+	}
+	return nil
+}
+
+// Matches reports whether the grant selects a target group with the given
+// ID and labels. New groups have ID 0 and are only selected by labels.
+func (g Grant) Matches(id uint64, labels map[string]interface{}) bool {
+	if g.GroupID != 0 && g.GroupID != id {
+		return false
+	}
+	for k, v := range g.Selector {
+		l, ok := labels[k]
+		if !ok || fmt.Sprint(l) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// GroupRole returns the role the token has on a target group. Tokens
+// without grants have their scope's role on every group; otherwise the
+// best matching grant counts, capped by the scope.
+func (t *Token) GroupRole(id uint64, labels map[string]interface{}) Role {
+	max := t.Scope.groupRole()
+	if len(t.Grants) == 0 {
+		return max
+	}
+	role := RoleNone
+	for _, g := range t.Grants {
+		if g.Matches(id, labels) && roleLevels[g.Role] > roleLevels[role] {
+			role = g.Role
+		}
+	}
+	if roleLevels[role] > roleLevels[max] {
+		return max
+	}
+	return role
+}
+
+// ScopeForGrants is the scope a token needs to use grants: read if they
+// only grant reading, write otherwise.
+func ScopeForGrants(grants []Grant) Scope {
+	for _, g := range grants {
+		if g.Role.Allows(RoleEditor) {
+			return ScopeWrite
+		}
+	}
+	return ScopeRead
+}
@@ -0,0 +1,224 @@
+package httpsd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MatchOp is the operator of a selector requirement.
+type MatchOp string
+
+const (
+	MatchEqual     MatchOp = "="
+	MatchNotEqual  MatchOp = "!="
+	MatchRegexp    MatchOp = "=~"
+	MatchNotRegexp MatchOp = "!~"
+	MatchIn        MatchOp = "in"
+	MatchNotIn     MatchOp = "notin"
+	MatchExists    MatchOp = "exists"
+	MatchNotExists MatchOp = "!exists"
+)
+
+// Requirement is a condition on one label of a target group.
+type Requirement struct {
+	Key    string
+	Op     MatchOp
+	Values []string
+	re     *regexp.Regexp
+}
+
+// Selector selects the target groups whose labels meet all its requirements.
+// The empty selector selects every group.
+type Selector []Requirement
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// setRE matches a set-based requirement such as `env in (prod, staging)`.
+var setRE = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s+(in|notin)\s*\((.*)\)$`)
+
+// ParseSelector parses a comma separated list of requirements:
+//
+//	key=value, key!=value    the label equals, or not, the value
+//	key=~regex, key!~regex   the label matches, or not, the anchored regex
+//	key in (a,b), key notin (a,b)
+//	key, !key                the label is set, or not
+//
+// As in Prometheus a missing label has the empty value. Values may be
+// double-quoted, e.g. to hold a comma.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range splitTerms(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+func parseRequirement(term string) (Requirement, error) {
+	if m := setRE.FindStringSubmatch(term); m != nil {
+		if strings.TrimSpace(m[3]) == "" {
+			return Requirement{}, fmt.Errorf("empty set in requirement %q", term)
+		}
+		r := Requirement{Key: m[1], Op: MatchOp(m[2])}
+		for _, v := range splitTerms(m[3]) {
+			r.Values = append(r.Values, unquote(strings.TrimSpace(v)))
+		}
+		return r, nil
+	}
+	if labelNameRE.MatchString(term) {
+		return Requirement{Key: term, Op: MatchExists}, nil
+	}
+	if strings.HasPrefix(term, "!") && labelNameRE.MatchString(strings.TrimSpace(term[1:])) {
+		return Requirement{Key: strings.TrimSpace(term[1:]), Op: MatchNotExists}, nil
+	}
+	i := strings.IndexAny(term, "=!")
+	if i < 0 {
+		return Requirement{}, fmt.Errorf("invalid requirement %q", term)
+	}
+	r := Requirement{Key: strings.TrimSpace(term[:i])}
+	rest := term[i:]
+	for _, op := range []MatchOp{MatchNotEqual, MatchRegexp, MatchNotRegexp, "==", MatchEqual} {
+		if strings.HasPrefix(rest, string(op)) {
+			r.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if r.Op == "==" {
+		r.Op = MatchEqual
+	}
+	if r.Op == "" {
+		return Requirement{}, fmt.Errorf("invalid requirement %q", term)
+	}
+	if !labelNameRE.MatchString(r.Key) {
+		return Requirement{}, fmt.Errorf("invalid label name %q in requirement %q", r.Key, term)
+	}
+	r.Values = []string{unquote(strings.TrimSpace(rest))}
+	if r.Op == MatchRegexp || r.Op == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + r.Values[0] + ")$")
+		if err != nil {
+			return Requirement{}, fmt.Errorf("invalid regex in requirement %q: %v", term, err)
+		}
+		r.re = re
+	}
+	return r, nil
+}
+
+// splitTerms splits s on the commas that are not quoted or inside
+// parentheses, brackets or braces.
+func splitTerms(s string) []string {
+	var (
+		terms  []string
+		depth  int
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			terms = append(terms, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+	}
+	return v
+}
+
+// Matches reports whether labels meet every requirement of the selector.
+func (sel Selector) Matches(labels map[string]interface{}) bool {
+	for _, r := range sel {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether labels meet the requirement.
+func (r Requirement) Matches(labels map[string]interface{}) bool {
+	l, ok := labels[r.Key]
+	v := ""
+	if ok && l != nil {
+		v = fmt.Sprint(l)
+	}
+	switch r.Op {
+	case MatchEqual:
+		return v == r.Values[0]
+	case MatchNotEqual:
+		return v != r.Values[0]
+	case MatchRegexp:
+		return r.re.MatchString(v)
+	case MatchNotRegexp:
+		return !r.re.MatchString(v)
+	case MatchIn, MatchNotIn:
+		in := false
+		for _, want := range r.Values {
+			in = in || v == want
+		}
+		return in == (r.Op == MatchIn)
+	case MatchExists:
+		return v != ""
+	case MatchNotExists:
+		return v == ""
+	}
+	return false
+}
+
+// String returns the selector in a canonical form, requirements sorted,
+// which parses back to the same selector.
+func (sel Selector) String() string {
+	terms := make([]string, 0, len(sel))
+	for _, r := range sel {
+		terms = append(terms, r.String())
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+func (r Requirement) String() string {
+	switch r.Op {
+	case MatchExists:
+		return r.Key
+	case MatchNotExists:
+		return "!" + r.Key
+	case MatchIn, MatchNotIn:
+		values := make([]string, 0, len(r.Values))
+		for _, v := range r.Values {
+			values = append(values, quote(v))
+		}
+		return r.Key + " " + string(r.Op) + " (" + strings.Join(values, ",") + ")"
+	}
+	return r.Key + string(r.Op) + quote(r.Values[0])
+}
+
+// quote quotes v if it would not parse back as is.
+func quote(v string) string {
+	if strings.ContainsAny(v, `,"()[]{} `) || v == "" {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
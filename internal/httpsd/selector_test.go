@@ -0,0 +1,54 @@
+package httpsd
+
+import "testing"
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]interface{}{"env": "prod", "team": "payments", "region": "eu-west-1"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env==prod", true},
+		{"env = prod , team != infra", true},
+		{"env=prod,team!=payments", false},
+		{"region=~eu-.*", true},
+		{"region=~eu", false},
+		{"region!~us-.*", true},
+		{"region=~eu-(west|north)-1,env=prod", true},
+		{"env in (prod, staging)", true},
+		{"env notin (prod,staging)", false},
+		{"team notin (infra)", true},
+		{"zone notin (a)", true},
+		{"team", true},
+		{"!zone", true},
+		{"!team", false},
+		{"zone=", true},
+		{"zone!=a", true},
+		{`team="payments"`, true},
+		{`path="a,b"`, false},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %v", tt.selector, err)
+			continue
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("%q matches %v = %t, want %t", tt.selector, labels, got, tt.want)
+		}
+		again, err := ParseSelector(sel.String())
+		if err != nil || again.String() != sel.String() {
+			t.Errorf("%q: String() = %q does not parse back: %q, %v", tt.selector, sel.String(), again.String(), err)
+		}
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, s := range []string{"env!prod", "1env=prod", "env=~(", "env in ()", "=prod", "env<prod"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("ParseSelector(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -2,9 +2,15 @@ package httpsd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -20,108 +26,181 @@ import (
 type Target struct {
 	ID   uint64 `json:"id"`
 	Addr string `json:"addr"`
+	// LeaseID is the lease the target is attached to, if any. The target
+	// is deleted when the lease expires.
+	LeaseID uint64 `json:"lease_id,omitempty"`
+	// Labels are set on the target on top of the labels of its group.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// targetRecord is how a target with labels is stored under its ID. A
+// target without labels is stored as its bare address.
+type targetRecord struct {
+	Addr   string            `json:"addr"`
+	Labels map[string]string `json:"labels"`
+}
+
+//encodeTarget returns the value stored under the ID of t
+func encodeTarget(t Target) ([]byte, error) {
+	if len(t.Labels) == 0 {
+		return []byte(t.Addr), nil
+	}
+	return json.Marshal(targetRecord{Addr: t.Addr, Labels: t.Labels})
+}
+
+//decodeTarget returns the target stored as v under id
+func decodeTarget(id uint64, v []byte) (Target, error) {
+	if len(v) == 0 || v[0] != '{' {
+		return Target{ID: id, Addr: string(v)}, nil
+	}
+	var rec targetRecord
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return Target{}, err
+	}
+	return Target{ID: id, Addr: rec.Addr, Labels: rec.Labels}, nil
 }
 
 type TargetGroup struct {
 	ID      uint64                 `json:"id"`
 	Targets []Target               `json:"targets"`
 	Labels  map[string]interface{} `json:"labels"`
+	// DefaultPort is the port of the target addresses given without one.
+	DefaultPort int `json:"default_port,omitempty"`
 }
 
+// Member holds the attributes a cluster member publishes about itself so
+// that the other members can reach its API.
+type Member struct {
+	ID     uint64 `json:"id"`
+	APIURL string `json:"api_url"`
+}
+
+var (
+	// ErrTargetGroupNotFound is returned when a target group ID does not exist.
+	ErrTargetGroupNotFound = errors.New("no such target group")
+	// ErrTargetExists is returned when adding an address a group already has.
+	ErrTargetExists = errors.New("ip already there")
+	// ErrTargetNotFound is returned for addresses a group does not have.
+	ErrTargetNotFound = errors.New("no such target")
+	// ErrForbidden is returned when the token of a command lost its role on
+	// a target group before the command was applied.
+	ErrForbidden = errors.New("token lost its role on the target group")
+	// ErrAddrGroupsChanged is returned when an address was added to a target
+	// group after removing it from its groups was authorized.
+	ErrAddrGroupsChanged = errors.New("address was added to other target groups, retry")
+
+	// ErrMemberExists is returned when adding a raft member twice.
+	ErrMemberExists = errors.New("member already exists")
+	// ErrMemberNotFound is returned for raft IDs that are not cluster members.
+	ErrMemberNotFound = errors.New("no such member")
+	// ErrMemberNotLearner is returned when promoting a member that already votes.
+	ErrMemberNotLearner = errors.New("member is not a learner")
+)
+
 type TargetStore struct {
+	mu         sync.RWMutex // held for writing only while Restore swaps db
 	db         *bolt.DB
 	rootBucket string
 }
 
-//New create a new HTTP service discovery
-func New(db *bolt.DB) *TargetStore {
-	db.Update(func(tx *bolt.Tx) error {
+//New create a new HTTP service discovery, bringing the layout of db up to
+//date
+func New(db *bolt.DB) (*TargetStore, error) {
+	ts := &TargetStore{db: db, rootBucket: "root"}
+	err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("root"))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
 		}
-		return nil
+		return ts.migrate(tx)
 	})
-	return &TargetStore{db: db, rootBucket: "root"}
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
 }
 
 func (ts *TargetStore) fillTargetGroupData(tgiBkt *bolt.Bucket, tgPtr *TargetGroup) error {
 	if tgiBkt == nil {
-		fmt.Printf("nil bucket \n")
 		return fmt.Errorf("bucket doesn't exist")
 	}
-	tgiBkt.ForEach(func(k, v []byte) error {
-		if bytes.Equal(k, []byte("label")) {
-			var labels map[string]interface{}
-			json.Unmarshal(v, &labels)
-			tgPtr.Labels = labels
-		} else if v == nil {
-			bkt := tgiBkt.Bucket(k) // targets bucket
-			targets := []Target{}
-			if bkt != nil {
-				bkt.ForEach(func(k, v []byte) error {
-					tid, err := strconv.ParseUint(string(k), 10, 64)
-					if err != nil {
-						return err
-					}
-					target := Target{ID: tid, Addr: string(v)}
-					targets = append(targets, target)
-					return nil
-				})
-				tgPtr.Targets = targets
+	if v := tgiBkt.Get([]byte("label")); v != nil {
+		var labels map[string]interface{}
+		json.Unmarshal(v, &labels)
+		tgPtr.Labels = labels
+	}
+	if v := tgiBkt.Get([]byte("default_port")); v != nil {
+		tgPtr.DefaultPort, _ = strconv.Atoi(string(v))
+	}
+	targets := []Target{}
+	if bkt := tgiBkt.Bucket([]byte("target")); bkt != nil {
+		err := bkt.ForEach(func(k, v []byte) error {
+			tid, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			target, err := decodeTarget(tid, v)
+			if err != nil {
+				return err
 			}
+			targets = append(targets, target)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	tgPtr.Targets = targets
 	return nil
 }
 
-func (ts *TargetStore) IPInTargetList(bkt *bolt.Bucket, ip string) bool {
-	exists := false
-	val := bkt.Get([]byte(ip))
-	if val != nil {
-		exists = true
-	}
+//IPInTargetList reports whether the target group of bucket tgiBkt has a
+//target at address ip
+func (ts *TargetStore) IPInTargetList(tgiBkt *bolt.Bucket, ip string) bool {
+	_, exists := targetByAddr(tgiBkt, ip)
 	return exists
 }
 
 //GetAllTargets returns a list of all target groups
 func (ts *TargetStore) GetAllTargetGroups() ([]TargetGroup, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
 	tgs := []TargetGroup{}
-	tx, err := ts.db.Begin(true)
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ts.rootBucket))
+		tgBkt := b.Bucket([]byte("TargetGroup")) //target group bucket
+		if tgBkt == nil {
+			return nil
+		}
+		return tgBkt.ForEach(func(k, v []byte) error {
+			tgid, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			tgObj := TargetGroup{ID: tgid}
+			tgiBkt := tgBkt.Bucket(k) //target group id bucket
+			if err := ts.fillTargetGroupData(tgiBkt, &tgObj); err != nil {
+				return err
+			}
+			ts.fillTargetLeases(tx, &tgObj)
+			tgs = append(tgs, tgObj)
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-	b := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := b.Bucket([]byte("TargetGroup")) //target group bucket
-	if tgBkt == nil {
-		return tgs, nil
-	}
-	tgBkt.ForEach(func(k, v []byte) error {
-		tgid, err := strconv.ParseUint(string(k), 10, 64)
-		if err != nil {
-			return err
-		}
-		tgObj := TargetGroup{ID: tgid}
-		tgiBkt := tgBkt.Bucket(k) //target group id bucket
-		ts.fillTargetGroupData(tgiBkt, &tgObj)
-		tgs = append(tgs, tgObj)
-		return nil
-	})
 	return tgs, nil
 }
 
-//CreateTargetGroup creates a new target group, returns error if
+//createTargetGroup creates a new target group, returns error if
 //target group couldn't be created
-func (ts *TargetStore) CreateTargetGroup(tg *TargetGroup) error {
-	// Start the transaction.
-	tx, err := ts.db.Begin(true)
-	if err != nil {
+func (ts *TargetStore) createTargetGroup(tx *bolt.Tx, tg *TargetGroup, auth *Token) error {
+	// the group has no ID to be granted on before it is created
+	if err := checkLabels(0, tg.Labels, auth, RoleAdmin); err != nil {
 		return err
 	}
-	defer tx.Rollback()
-
 	// Retrieve the root bucket.
 	// Assume this has already been created when the store was set up.
 	root := tx.Bucket([]byte(ts.rootBucket))
@@ -135,6 +214,7 @@ func (ts *TargetStore) CreateTargetGroup(tg *TargetGroup) error {
 	if err != nil {
 		return err
 	}
+	tg.ID = tgID
 
 	targetGroupBkt, err := bkt.CreateBucket([]byte(strconv.FormatUint(tgID, 10)))
 	if err != nil {
@@ -146,163 +226,578 @@ func (ts *TargetStore) CreateTargetGroup(tg *TargetGroup) error {
 	} else if err := targetGroupBkt.Put([]byte("label"), buf); err != nil {
 		return err
 	}
+	if tg.DefaultPort != 0 {
+		if err := targetGroupBkt.Put([]byte("default_port"), []byte(strconv.Itoa(tg.DefaultPort))); err != nil {
+			return err
+		}
+	}
 
 	targetBkt, err := targetGroupBkt.CreateBucket([]byte("target"))
 	if err != nil {
 		return err
 	}
-	for _, tgt := range tg.Targets {
+	for i, tgt := range tg.Targets {
+		if ts.IPInTargetList(targetGroupBkt, tgt.Addr) {
+			return ErrTargetExists
+		}
 		id, _ := targetBkt.NextSequence()
-		targetBkt.Put([]byte(strconv.FormatUint(id, 10)), []byte(tgt.Addr))
-		targetBkt.Put([]byte(tgt.Addr), []byte(strconv.FormatUint(uint64(id), 10)))
-	}
-	if err := tx.Commit(); err != nil {
-		return err
+		tg.Targets[i].ID = id
+		if err := ts.putTarget(tx, targetGroupBkt, tgID, tg.Targets[i]); err != nil {
+			return err
+		}
+		if tgt.LeaseID != 0 {
+			if err := ts.attachLease(tx, tgt.LeaseID, tgID, id); err != nil {
+				return err
+			}
+		}
 	}
-
 	return nil
 }
 
 //GetTargetGroup returns a target group with ID, returns error if
 //target group doesn't exist
 func (ts *TargetStore) GetTargetGroup(id uint64) (*TargetGroup, error) {
-	tx, err := ts.db.Begin(true)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
-	// Retrieve the root bucket.
-	// Assume this has already been created when the store was set up.
-	root := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := root.Bucket([]byte("TargetGroup"))
-
-	tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(id, 10)))
-	if tgBkt == nil {
-		return nil, fmt.Errorf("no such target group")
-	}
-	fmt.Printf("Target Values is %#v\n", tgiBkt)
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
 	tgObj := TargetGroup{ID: id}
-	err = ts.fillTargetGroupData(tgiBkt, &tgObj)
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		// Retrieve the root bucket.
+		// Assume this has already been created when the store was set up.
+		tgiBkt, err := ts.targetGroupBucket(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := ts.fillTargetGroupData(tgiBkt, &tgObj); err != nil {
+			return err
+		}
+		ts.fillTargetLeases(tx, &tgObj)
+		return nil
+	})
 	if err != nil {
-		fmt.Printf("returning error from GetTargetGroup")
 		return nil, err
 	}
 	return &tgObj, nil
 }
 
-// UpdateTarget updates port of a target, returns error if
+// updateTargetGroup adds targets and labels to a target group, returns error if
 // target group doesn't exist
-func (ts *TargetStore) UpdateTargetGroup(tg *TargetGroup) error {
-	tx, err := ts.db.Begin(true)
+func (ts *TargetStore) updateTargetGroup(tx *bolt.Tx, tg *TargetGroup, auth *Token) error {
+	tgiBkt, err := ts.targetGroupBucket(tx, tg.ID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	// Retrieve the root bucket.
-	// Assume this has already been created when the store was set up.
-	root := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := root.Bucket([]byte("TargetGroup"))
-	tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(tg.ID, 10)))
+	if err := checkRole(tgiBkt, tg.ID, auth, RoleEditor); err != nil {
+		return err
+	}
 	tBkt := tgiBkt.Bucket([]byte("target"))
 	if tg.Targets != nil {
-		fmt.Printf("targets are not nil, updating them\n")
-		for _, tgt := range tg.Targets {
-			if ts.IPInTargetList(tBkt, tgt.Addr) {
-				return fmt.Errorf("ip already there")
+		for i, tgt := range tg.Targets {
+			if id, ok := targetByAddr(tgiBkt, tgt.Addr); ok && tgt.LeaseID != 0 {
+				// registering again moves the target to the new lease
+				// and sets its labels
+				tg.Targets[i].ID = id
+				if err := ts.putTarget(tx, tgiBkt, tg.ID, tg.Targets[i]); err != nil {
+					return err
+				}
+				if err := ts.attachLease(tx, tgt.LeaseID, tg.ID, id); err != nil {
+					return err
+				}
+			} else if ok {
+				return ErrTargetExists
 			} else {
 				id, _ := tBkt.NextSequence()
-				fmt.Printf("adding %s \n", tgt.Addr)
-				tBkt.Put([]byte(strconv.FormatUint(uint64(id), 10)), []byte(tgt.Addr))
-				tBkt.Put([]byte(tgt.Addr), []byte(strconv.FormatUint(uint64(id), 10)))
+				tg.Targets[i].ID = id
+				if err := ts.putTarget(tx, tgiBkt, tg.ID, tg.Targets[i]); err != nil {
+					return err
+				}
+				if tgt.LeaseID != 0 {
+					if err := ts.attachLease(tx, tgt.LeaseID, tg.ID, id); err != nil {
+						return err
+					}
+				}
 			}
 		}
 	}
+	if tg.DefaultPort != 0 {
+		if err := tgiBkt.Put([]byte("default_port"), []byte(strconv.Itoa(tg.DefaultPort))); err != nil {
+			return err
+		}
+	}
 	if tg.Labels != nil {
 		var label map[string]interface{}
 		json.Unmarshal(tgiBkt.Get([]byte("label")), &label)
+		if label == nil {
+			label = map[string]interface{}{}
+		}
 		for k := range tg.Labels {
 			label[k] = tg.Labels[k]
 		}
+		if err := checkLabels(tg.ID, label, auth, RoleEditor); err != nil {
+			return err
+		}
 		if buf, err := json.Marshal(label); err != nil {
 			return err
 		} else if err := tgiBkt.Put([]byte("label"), buf); err != nil {
 			return err
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		return err
-	}
 	return nil
 }
 
-//DeleteTarget deletes a target from targets of a target group, returns error if
+//deleteTargetGroup deletes a target group, returns error if
 //target group doesn't exist
-func (ts *TargetStore) DeleteTargetGroup(id uint64) error {
-	tx, err := ts.db.Begin(true)
+func (ts *TargetStore) deleteTargetGroup(tx *bolt.Tx, id uint64, auth *Token) error {
+	tgBkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("TargetGroup"))
+	if tgBkt == nil {
+		return ErrTargetGroupNotFound
+	}
+	if tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(id, 10))); tgiBkt != nil {
+		if err := checkRole(tgiBkt, id, auth, RoleAdmin); err != nil {
+			return err
+		}
+		tg := TargetGroup{ID: id}
+		if err := ts.fillTargetGroupData(tgiBkt, &tg); err != nil {
+			return err
+		}
+		for _, t := range tg.Targets {
+			if _, err := ts.removeTarget(tx, tgiBkt, id, t.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return tgBkt.DeleteBucket([]byte(strconv.FormatUint(id, 10)))
+}
+
+//deleteTarget deletes a target from targets of a target group, returns error if
+//target group doesn't exist
+func (ts *TargetStore) deleteTarget(tx *bolt.Tx, tgID uint64, tID uint64, auth *Token) error {
+	tgiBkt, err := ts.targetGroupBucket(tx, tgID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	// Retrieve the root bucket.
-	// Assume this has already been created when the store was set up.
-	root := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := root.Bucket([]byte("TargetGroup"))
-	err = tgBkt.DeleteBucket([]byte(strconv.FormatUint(id, 10)))
+	if err := checkRole(tgiBkt, tgID, auth, RoleEditor); err != nil {
+		return err
+	}
+	_, err = ts.removeTarget(tx, tgiBkt, tgID, tID)
+	return err
+}
+
+//deleteTargetAddr deletes the target with address addr from a target group,
+//returns ErrTargetNotFound if the group doesn't have it
+func (ts *TargetStore) deleteTargetAddr(tx *bolt.Tx, tgID uint64, addr string, auth *Token) error {
+	tgiBkt, err := ts.targetGroupBucket(tx, tgID)
 	if err != nil {
 		return err
 	}
-	if err := tx.Commit(); err != nil {
+	if err := checkRole(tgiBkt, tgID, auth, RoleEditor); err != nil {
 		return err
 	}
+	id, ok := targetByAddr(tgiBkt, addr)
+	if !ok {
+		return ErrTargetNotFound
+	}
+	_, err = ts.removeTarget(tx, tgiBkt, tgID, id)
+	return err
+}
+
+//moveTarget moves the target with address addr from one target group to
+//another, keeping its labels and lease, and returns its ID in the new group
+func (ts *TargetStore) moveTarget(tx *bolt.Tx, fromID, toID uint64, addr string, auth *Token) (uint64, error) {
+	from, err := ts.targetGroupBucket(tx, fromID)
+	if err != nil {
+		return 0, err
+	}
+	to, err := ts.targetGroupBucket(tx, toID)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkRole(from, fromID, auth, RoleEditor); err != nil {
+		return 0, err
+	}
+	if err := checkRole(to, toID, auth, RoleEditor); err != nil {
+		return 0, err
+	}
+	id, ok := targetByAddr(from, addr)
+	if !ok {
+		return 0, ErrTargetNotFound
+	}
+	if ts.IPInTargetList(to, addr) {
+		return 0, ErrTargetExists
+	}
+	t, err := decodeTarget(id, from.Bucket([]byte("target")).Get([]byte(strconv.FormatUint(id, 10))))
+	if err != nil {
+		return 0, err
+	}
+	var leaseID uint64
+	if idx := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("LeaseTarget")); idx != nil {
+		leaseID, _ = strconv.ParseUint(string(idx.Get(leaseTargetKey(fromID, id))), 10, 64)
+	}
+	if _, err := ts.removeTarget(tx, from, fromID, id); err != nil {
+		return 0, err
+	}
+	if t.ID, err = to.Bucket([]byte("target")).NextSequence(); err != nil {
+		return 0, err
+	}
+	if err := ts.putTarget(tx, to, toID, t); err != nil {
+		return 0, err
+	}
+	if leaseID != 0 {
+		if err := ts.attachLease(tx, leaseID, toID, t.ID); err != nil {
+			return 0, err
+		}
+	}
+	return t.ID, nil
+}
+
+//removeAddr deletes the targets with address addr from every target group,
+//returns the IDs of the groups it was removed from. It fails with
+//ErrAddrGroupsChanged if the address is in a group not in authorized.
+func (ts *TargetStore) removeAddr(tx *bolt.Tx, addr string, authorized []uint64, auth *Token) ([]uint64, error) {
+	groups, err := ts.addrGroups(tx, addr)
+	if err != nil {
+		return nil, err
+	}
+	allowed := map[uint64]bool{}
+	for _, groupID := range authorized {
+		allowed[groupID] = true
+	}
+	for _, groupID := range groups {
+		if !allowed[groupID] {
+			return nil, ErrAddrGroupsChanged
+		}
+	}
+	// deleting updates the index, iterate over a copy
+	removed := append([]uint64{}, groups...)
+	for _, groupID := range removed {
+		if err := ts.deleteTargetAddr(tx, groupID, addr, auth); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+//checkRole returns ErrForbidden unless auth has role on the target group
+//of bucket tgiBkt with its stored labels, a nil auth is admin
+func checkRole(tgiBkt *bolt.Bucket, groupID uint64, auth *Token, role Role) error {
+	if auth == nil {
+		return nil
+	}
+	var labels map[string]interface{}
+	json.Unmarshal(tgiBkt.Get([]byte("label")), &labels)
+	return checkLabels(groupID, labels, auth, role)
+}
+
+//checkLabels returns ErrForbidden unless auth has role on the target group
+//with the labels it has once changed, a nil auth is admin
+func checkLabels(groupID uint64, labels map[string]interface{}, auth *Token, role Role) error {
+	if auth != nil && !auth.GroupRole(groupID, labels).Allows(role) {
+		return ErrForbidden
+	}
 	return nil
 }
 
-//DeleteTarget deletes a target from targets of a target group, returns error if
+//deleteLabel deletes a label from a target group, returns error if
 //target group doesn't exist
-func (ts *TargetStore) DeleteTarget(tgID uint64, tID uint64) error {
-	tx, err := ts.db.Begin(true)
+func (ts *TargetStore) deleteLabel(tx *bolt.Tx, tgID uint64, label_key string, auth *Token) error {
+	tgiBkt, err := ts.targetGroupBucket(tx, tgID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	// Retrieve the root bucket.
-	// Assume this has already been created when the store was set up.
-	root := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := root.Bucket([]byte("TargetGroup"))
-	tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(tgID, 10)))
-	if tgiBkt == nil {
-		return fmt.Errorf("no such target group")
+	if err := checkRole(tgiBkt, tgID, auth, RoleEditor); err != nil {
+		return err
 	}
-	tBkt := tgiBkt.Bucket([]byte("target"))
-	err = tBkt.Delete([]byte(strconv.FormatUint(tID, 10)))
-	if err != nil {
+	var label map[string]interface{}
+	json.Unmarshal(tgiBkt.Get([]byte("label")), &label)
+	delete(label, label_key)
+	if err := checkLabels(tgID, label, auth, RoleEditor); err != nil {
 		return err
 	}
-	if err := tx.Commit(); err != nil {
+	if buf, err := json.Marshal(label); err != nil {
+		return err
+	} else if err := tgiBkt.Put([]byte("label"), buf); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (ts *TargetStore) DeleteLabel(tgID uint64, label_key string) error {
+// targetGroupBucket returns the bucket of target group id, or
+// ErrTargetGroupNotFound if there is no such group.
+func (ts *TargetStore) targetGroupBucket(tx *bolt.Tx, id uint64) (*bolt.Bucket, error) {
+	tgBkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("TargetGroup"))
+	if tgBkt == nil {
+		return nil, ErrTargetGroupNotFound
+	}
+	tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(id, 10)))
+	if tgiBkt == nil {
+		return nil, ErrTargetGroupNotFound
+	}
+	return tgiBkt, nil
+}
+
+// Apply executes a command committed through the raft log at the given
+// index. The index is stored in the same transaction as the mutation so
+// that commands replayed from the WAL after a restart are applied only once.
+// The returned error is the command's own error, e.g. ErrTargetGroupNotFound,
+// or ErrForbidden if cmd.Auth lost its role on a target group it changes.
+func (ts *TargetStore) Apply(index uint64, cmd *Command) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("write", time.Now())
 	tx, err := ts.db.Begin(true)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	root := tx.Bucket([]byte(ts.rootBucket))
-	tgBkt := root.Bucket([]byte("TargetGroup"))
-	tgiBkt := tgBkt.Bucket([]byte(strconv.FormatUint(tgID, 10)))
-	var label map[string]interface{}
-	json.Unmarshal(tgiBkt.Get([]byte("label")), &label)
-	delete(label, label_key)
-	if buf, err := json.Marshal(label); err != nil {
+	if index <= ts.appliedIndex(tx) {
+		return nil
+	}
+	if cmdErr := ts.apply(tx, cmd); cmdErr != nil {
+		// discard the partial mutation but still consume the index
+		tx.Rollback()
+		if err := ts.db.Update(func(tx *bolt.Tx) error {
+			return ts.setAppliedIndex(tx, index)
+		}); err != nil {
+			return err
+		}
+		return cmdErr
+	}
+	if err := ts.setAppliedIndex(tx, index); err != nil {
 		return err
-	} else if err := tgiBkt.Put([]byte("label"), buf); err != nil {
+	}
+	return tx.Commit()
+}
+
+func (ts *TargetStore) apply(tx *bolt.Tx, cmd *Command) error {
+	switch cmd.Op {
+	case OpCreateTargetGroup:
+		return ts.createTargetGroup(tx, cmd.TargetGroup, cmd.Auth)
+	case OpUpdateTargetGroup:
+		return ts.updateTargetGroup(tx, cmd.TargetGroup, cmd.Auth)
+	case OpDeleteTargetGroup:
+		return ts.deleteTargetGroup(tx, cmd.GroupID, cmd.Auth)
+	case OpDeleteTarget:
+		return ts.deleteTarget(tx, cmd.GroupID, cmd.TargetID, cmd.Auth)
+	case OpDeleteLabel:
+		return ts.deleteLabel(tx, cmd.GroupID, cmd.LabelKey, cmd.Auth)
+	case OpPublishMember:
+		return ts.putMember(tx, cmd.Member)
+	case OpRemoveMember:
+		return ts.deleteMember(tx, cmd.Member.ID)
+	case OpCreateToken:
+		return ts.createToken(tx, cmd.Token)
+	case OpDeleteToken:
+		return ts.deleteToken(tx, cmd.TokenID)
+	case OpPutJob:
+		return ts.putJob(tx, cmd.Job)
+	case OpDeleteJob:
+		return ts.deleteJob(tx, cmd.JobName)
+	case OpGrantLease:
+		return ts.grantLease(tx, cmd.Lease)
+	case OpRevokeLease:
+		return ts.revokeLease(tx, cmd.LeaseID, cmd.Auth)
+	case OpDeleteTargetAddr:
+		return ts.deleteTargetAddr(tx, cmd.GroupID, cmd.Addr, cmd.Auth)
+	case OpMoveTarget:
+		id, err := ts.moveTarget(tx, cmd.GroupID, cmd.ToGroupID, cmd.Addr, cmd.Auth)
+		cmd.TargetID = id
+		return err
+	case OpRemoveAddr:
+		groups, err := ts.removeAddr(tx, cmd.Addr, cmd.GroupIDs, cmd.Auth)
+		cmd.GroupIDs = groups
+		return err
+	}
+	return fmt.Errorf("unknown command op %q", cmd.Op)
+}
+
+//AppliedIndex returns the raft index of the last command applied to the store
+func (ts *TargetStore) AppliedIndex() (uint64, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var index uint64
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		index = ts.appliedIndex(tx)
+		return nil
+	})
+	return index, err
+}
+
+func (ts *TargetStore) appliedIndex(tx *bolt.Tx) uint64 {
+	v := tx.Bucket([]byte(ts.rootBucket)).Get([]byte("appliedIndex"))
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (ts *TargetStore) setAppliedIndex(tx *bolt.Tx, index uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return tx.Bucket([]byte(ts.rootBucket)).Put([]byte("appliedIndex"), buf)
+}
+
+//GetMember returns the published attributes of cluster member id
+func (ts *TargetStore) GetMember(id uint64) (*Member, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var m *Member
+	ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Member"))
+		if bkt == nil {
+			return nil
+		}
+		if v := bkt.Get([]byte(strconv.FormatUint(id, 10))); v != nil {
+			m = &Member{}
+			return json.Unmarshal(v, m)
+		}
+		return nil
+	})
+	return m, m != nil
+}
+
+//GetMembers returns the published attributes of all cluster members
+func (ts *TargetStore) GetMembers() ([]Member, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	members := []Member{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Member"))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			var m Member
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			members = append(members, m)
+			return nil
+		})
+	})
+	return members, err
+}
+
+func (ts *TargetStore) putMember(tx *bolt.Tx, m *Member) error {
+	bkt, err := tx.Bucket([]byte(ts.rootBucket)).CreateBucketIfNotExists([]byte("Member"))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(strconv.FormatUint(m.ID, 10)), buf)
+}
+
+func (ts *TargetStore) deleteMember(tx *bolt.Tx, id uint64) error {
+	bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Member"))
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete([]byte(strconv.FormatUint(id, 10)))
+}
+
+//Snapshot writes a consistent copy of the whole bolt file, used as the raft
+//snapshot payload. Bucket sequences are part of the copy, so IDs handed out
+//after a restore keep increasing.
+func (ts *TargetStore) Snapshot() ([]byte, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var buf bytes.Buffer
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Restore replaces the bolt file with a copy written by Snapshot and marks
+//the store as applied up to index. The copy is prepared next to the
+//current file and renamed over it, so a crash leaves either one intact.
+func (ts *TargetStore) Restore(data []byte, index uint64) error {
+	path := ts.db.Path()
+	tmp := path + ".restore"
+	if err := writeFileSync(tmp, data); err != nil {
 		return err
 	}
-	if err := tx.Commit(); err != nil {
+	db, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(ts.rootBucket)) == nil {
+			return fmt.Errorf("snapshot has no %s bucket", ts.rootBucket)
+		}
+		if err := ts.migrate(tx); err != nil {
+			return err
+		}
+		return ts.setAppliedIndex(tx, index)
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.db.Close(); err != nil {
+		os.Remove(tmp)
+		return ts.reopen(path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return ts.reopen(path, err)
+	}
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		// the store was replaced, there is nothing to go back to
+		log.Fatalf("httpsd: cannot open restored store %s (%v)", path, err)
+	}
+	ts.db = db
 	return nil
 }
+
+//reopen opens the store at path again after a failed restore and returns
+//the restore error err, the store must not be left closed
+func (ts *TargetStore) reopen(path string, err error) error {
+	db, oerr := bolt.Open(path, 0600, nil)
+	if oerr != nil {
+		log.Fatalf("httpsd: cannot reopen store %s after failed restore (%v): %v", path, err, oerr)
+	}
+	ts.db = db
+	return fmt.Errorf("restore: %w", err)
+}
+
+//Close closes the underlying bolt database
+func (ts *TargetStore) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.db.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
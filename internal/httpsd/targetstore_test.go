@@ -0,0 +1,646 @@
+package httpsd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestTargetStore(t *testing.T) *TargetStore {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "httpsd.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	return ts
+}
+
+func TestTargetStoreSnapshotRestore(t *testing.T) {
+	src := newTestTargetStore(t)
+	cmds := []*Command{
+		{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Labels: map[string]interface{}{"job": "a"}, Targets: []Target{{Addr: "10.0.0.1:9100"}}}},
+		{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Labels: map[string]interface{}{"job": "b"}}},
+		{Op: OpUpdateTargetGroup, TargetGroup: &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.2:9100"}}}},
+		{Op: OpDeleteTargetGroup, GroupID: 2},
+		{Op: OpPublishMember, Member: &Member{ID: 1, APIURL: "http://127.0.0.1:12380"}},
+	}
+	for i, cmd := range cmds {
+		if err := src.Apply(uint64(i+1), cmd); err != nil {
+			t.Fatalf("#%d: apply %s: %v", i, cmd.Op, err)
+		}
+	}
+	data, err := src.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestTargetStore(t)
+	if err := dst.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Restore(data, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if index, err := dst.AppliedIndex(); err != nil || index != 10 {
+		t.Errorf("applied index = %d, %v, want 10", index, err)
+	}
+	tg, err := dst.GetTargetGroup(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tg.Labels["job"] != "a" {
+		t.Errorf("labels = %v, want job=a", tg.Labels)
+	}
+	if _, err := dst.GetTargetGroup(2); err != ErrTargetGroupNotFound {
+		t.Errorf("deleted group 2: err = %v, want %v", err, ErrTargetGroupNotFound)
+	}
+	if m, ok := dst.GetMember(1); !ok || m.APIURL != "http://127.0.0.1:12380" {
+		t.Errorf("member 1 = %v, %t", m, ok)
+	}
+
+	// sequences survive the restore, so deleted IDs are not handed out again
+	create := &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{}}
+	if err := dst.Apply(11, create); err != nil {
+		t.Fatal(err)
+	}
+	if create.TargetGroup.ID != 3 {
+		t.Errorf("group id after restore = %d, want 3", create.TargetGroup.ID)
+	}
+	update := &Command{Op: OpUpdateTargetGroup, TargetGroup: &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.3:9100"}}}}
+	if err := dst.Apply(12, update); err != nil {
+		t.Fatal(err)
+	}
+	if id := update.TargetGroup.Targets[0].ID; id != 3 {
+		t.Errorf("target id after restore = %d, want 3", id)
+	}
+}
+
+func TestTargetStoreRestoreFailure(t *testing.T) {
+	ts := newTestTargetStore(t)
+	if err := ts.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{}}); err != nil {
+		t.Fatal(err)
+	}
+	path := ts.db.Path()
+
+	// a bolt file without the root bucket
+	other, err := bolt.Open(filepath.Join(t.TempDir(), "other.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	other.View(func(tx *bolt.Tx) error {
+		var buf bytes.Buffer
+		_, err := tx.WriteTo(&buf)
+		data = buf.Bytes()
+		return err
+	})
+	other.Close()
+	for _, snap := range [][]byte{[]byte("not a bolt file"), data} {
+		if err := ts.Restore(snap, 10); err == nil {
+			t.Errorf("Restore(%d bytes) succeeded, want error", len(snap))
+		}
+		if _, err := os.Stat(path + ".restore"); !os.IsNotExist(err) {
+			t.Errorf("restore file left behind: %v", err)
+		}
+		if _, err := ts.GetTargetGroup(1); err != nil {
+			t.Errorf("store after failed restore: %v", err)
+		}
+	}
+
+	// the store is reopened when the swap fails after closing it
+	ts.mu.Lock()
+	ts.db.Close()
+	err = ts.reopen(path, os.ErrPermission)
+	ts.mu.Unlock()
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("reopen() = %v, want %v", err, os.ErrPermission)
+	}
+	if index, err := ts.AppliedIndex(); err != nil || index != 1 {
+		t.Errorf("applied index after reopen = %d, %v, want 1", index, err)
+	}
+}
+
+func TestTargetStoreApplySkipsApplied(t *testing.T) {
+	ts := newTestTargetStore(t)
+	for i := uint64(1); i <= 2; i++ {
+		if err := ts.Apply(i, &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// entries replayed from the raft log after a restart
+	for i := uint64(1); i <= 2; i++ {
+		cmd := &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{}}
+		if err := ts.Apply(i, cmd); err != nil {
+			t.Errorf("replaying index %d: %v", i, err)
+		}
+		if cmd.TargetGroup.ID != 0 {
+			t.Errorf("replaying index %d created group %d", i, cmd.TargetGroup.ID)
+		}
+	}
+	if tgs, err := ts.GetAllTargetGroups(); err != nil || len(tgs) != 2 {
+		t.Errorf("target groups after a replay = %+v, %v, want 2", tgs, err)
+	}
+	if index, err := ts.AppliedIndex(); err != nil || index != 2 {
+		t.Errorf("applied index = %d, %v, want 2", index, err)
+	}
+}
+
+func TestTargetStoreApplyFailureConsumesIndex(t *testing.T) {
+	ts := newTestTargetStore(t)
+	if err := ts.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Targets: []Target{{Addr: "10.0.0.1:9100"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	// the second target is a duplicate, the first must not be kept either
+	update := &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.2:9100"}, {Addr: "10.0.0.1:9100"}}}
+	if err := ts.Apply(2, &Command{Op: OpUpdateTargetGroup, TargetGroup: update}); err != ErrTargetExists {
+		t.Fatalf("duplicate target = %v, want %v", err, ErrTargetExists)
+	}
+	if index, err := ts.AppliedIndex(); err != nil || index != 2 {
+		t.Errorf("applied index after a failed command = %d, %v, want 2", index, err)
+	}
+	if tg, err := ts.GetTargetGroup(1); err != nil || len(tg.Targets) != 1 {
+		t.Errorf("target group after a failed command = %+v, %v, want it unchanged", tg, err)
+	}
+	// the index is used up, another command at it is skipped
+	if err := ts.Apply(2, &Command{Op: OpDeleteTargetGroup, GroupID: 1}); err != nil {
+		t.Errorf("replaying a failed index: %v", err)
+	}
+	if _, err := ts.GetTargetGroup(1); err != nil {
+		t.Errorf("replayed index was applied: %v", err)
+	}
+}
+
+func TestTargetStoreTokens(t *testing.T) {
+	ts := newTestTargetStore(t)
+	create := &Command{Op: OpCreateToken, Token: &Token{Name: "ci", Hash: HashToken("secret"), Scope: ScopeWrite}}
+	if err := ts.Apply(1, create); err != nil {
+		t.Fatal(err)
+	}
+	if create.Token.ID != 1 {
+		t.Errorf("token id = %d, want 1", create.Token.ID)
+	}
+	tok, ok := ts.GetTokenByHash(HashToken("secret"))
+	if !ok || tok.Name != "ci" || tok.Scope != ScopeWrite {
+		t.Fatalf("GetTokenByHash = %+v, %t", tok, ok)
+	}
+	if _, ok := ts.GetTokenByHash(HashToken("other")); ok {
+		t.Error("found a token for an unknown secret")
+	}
+
+	if err := ts.Apply(2, &Command{Op: OpDeleteToken, TokenID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts.GetTokenByHash(HashToken("secret")); ok {
+		t.Error("deleted token still found by hash")
+	}
+	if err := ts.Apply(3, &Command{Op: OpDeleteToken, TokenID: 1}); err != ErrTokenNotFound {
+		t.Errorf("deleting twice: err = %v, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope, required Scope
+		want            bool
+	}{
+		{ScopeAdmin, ScopeWrite, true},
+		{ScopeWrite, ScopeRead, true},
+		{ScopeRead, ScopeDiscover, true},
+		{ScopeRead, ScopeWrite, false},
+		{ScopeDiscover, ScopeRead, false},
+		{Scope("root"), ScopeDiscover, false},
+	}
+	for _, tt := range tests {
+		if got := tt.scope.Allows(tt.required); got != tt.want {
+			t.Errorf("%s.Allows(%s) = %t, want %t", tt.scope, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestTokenGroupRole(t *testing.T) {
+	payments := map[string]interface{}{"team": "payments", "env": "prod"}
+	search := map[string]interface{}{"team": "search"}
+	tests := []struct {
+		token  Token
+		id     uint64
+		labels map[string]interface{}
+		want   Role
+	}{
+		{Token{Scope: ScopeWrite}, 1, search, RoleAdmin},
+		{Token{Scope: ScopeRead}, 1, search, RoleReader},
+		{Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, Selector: map[string]string{"team": "payments"}}}}, 1, payments, RoleEditor},
+		{Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, Selector: map[string]string{"team": "payments"}}}}, 2, search, RoleNone},
+		{Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleReader}, {Role: RoleAdmin, GroupID: 2}}}, 2, search, RoleAdmin},
+		{Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleReader}, {Role: RoleAdmin, GroupID: 2}}}, 3, search, RoleReader},
+		{Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleAdmin, GroupID: 2}}}, 0, search, RoleNone},
+		{Token{Scope: ScopeRead, Grants: []Grant{{Role: RoleAdmin, Selector: map[string]string{"team": "search"}}}}, 2, search, RoleReader},
+	}
+	for i, tt := range tests {
+		if got := tt.token.GroupRole(tt.id, tt.labels); got != tt.want {
+			t.Errorf("#%d: GroupRole(%d, %v) = %q, want %q", i, tt.id, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	ts := newTestTargetStore(t)
+	for i, addr := range []string{"10.0.0.1:9100", "10.0.0.2:9100"} {
+		tg := &TargetGroup{Targets: []Target{{Addr: addr}}}
+		if err := ts.Apply(uint64(i+1), &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `
+# HELP httpsd_target_groups Number of target groups.
+# TYPE httpsd_target_groups gauge
+httpsd_target_groups 2
+# HELP httpsd_targets Number of targets in all target groups.
+# TYPE httpsd_targets gauge
+httpsd_targets 2
+`
+	if err := testutil.CollectAndCompare(NewCollector(ts), strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTargetStoreJobs(t *testing.T) {
+	ts := newTestTargetStore(t)
+	job := &Job{Name: "node", Match: "env=prod", Labels: map[string]string{"job": "node"}}
+	if err := job.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Apply(1, &Command{Op: OpPutJob, Job: job}); err != nil {
+		t.Fatal(err)
+	}
+	replaced := &Job{Name: "node", Match: "env=dev"}
+	if err := ts.Apply(2, &Command{Op: OpPutJob, Job: replaced}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ts.GetJob("node")
+	if err != nil || got.Match != "env=dev" || got.Labels != nil {
+		t.Errorf("GetJob = %+v, %v, want the replaced job", got, err)
+	}
+	if err := ts.Apply(3, &Command{Op: OpDeleteJob, JobName: "node"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.GetJob("node"); err != ErrJobNotFound {
+		t.Errorf("GetJob after delete: err = %v, want %v", err, ErrJobNotFound)
+	}
+	if err := ts.Apply(4, &Command{Op: OpDeleteJob, JobName: "node"}); err != ErrJobNotFound {
+		t.Errorf("deleting twice: err = %v, want %v", err, ErrJobNotFound)
+	}
+
+	for _, j := range []Job{{Name: "a/b"}, {Name: ""}, {Name: "a", Match: "env<prod"}, {Name: "a", Labels: map[string]string{"1x": "y"}}} {
+		if err := j.Validate(); err == nil {
+			t.Errorf("%+v is valid, want error", j)
+		}
+	}
+}
+
+func TestTargetStoreLeases(t *testing.T) {
+	ts := newTestTargetStore(t)
+	for i := 1; i <= 2; i++ {
+		if err := ts.Apply(uint64(i), &Command{Op: OpGrantLease, Lease: &Lease{TTL: 10}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Apply(3, &Command{Op: OpGrantLease, Lease: &Lease{}}); err == nil {
+		t.Error("granting a lease without TTL succeeded")
+	}
+	for i, addr := range []string{"10.0.0.1:9100", "10.0.0.2:9100"} {
+		tg := &TargetGroup{Targets: []Target{{Addr: addr, LeaseID: 1}}}
+		if err := ts.Apply(uint64(4+i), &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Apply(6, &Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Targets: []Target{{Addr: "10.0.0.3:9100", LeaseID: 9}}}}); err != ErrLeaseNotFound {
+		t.Errorf("attaching to a missing lease: err = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	// registering again with another lease moves the target to it
+	moved := &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.1:9100", LeaseID: 2}}}
+	if err := ts.Apply(7, &Command{Op: OpUpdateTargetGroup, TargetGroup: moved}); err != nil {
+		t.Fatal(err)
+	}
+	l1, err := ts.GetLease(1)
+	if err != nil || len(l1.Targets) != 1 || l1.Targets[0] != (LeaseTarget{GroupID: 2, TargetID: 1}) {
+		t.Errorf("lease 1 = %+v, %v, want the target of group 2", l1, err)
+	}
+	if tg, err := ts.GetTargetGroup(1); err != nil || tg.Targets[0].LeaseID != 2 {
+		t.Errorf("target group 1 = %+v, %v, want its target on lease 2", tg, err)
+	}
+
+	// the token may only read group 2 by the time the revoke is applied
+	reader := &Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, GroupID: 1}, {Role: RoleReader, GroupID: 2}}}
+	if err := ts.Apply(8, &Command{Op: OpRevokeLease, LeaseID: 1, Auth: reader}); err != ErrForbidden {
+		t.Errorf("revoking as reader: err = %v, want %v", err, ErrForbidden)
+	}
+	if l, err := ts.GetLease(1); err != nil || len(l.Targets) != 1 {
+		t.Errorf("lease 1 after a forbidden revoke = %+v, %v, want it unchanged", l, err)
+	}
+	if err := ts.Apply(9, &Command{Op: OpRevokeLease, LeaseID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.GetLease(1); err != ErrLeaseNotFound {
+		t.Errorf("GetLease after revoke: err = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if tg, err := ts.GetTargetGroup(2); err != nil || len(tg.Targets) != 0 {
+		t.Errorf("target group 2 = %+v, %v, want no targets", tg, err)
+	}
+	again := &TargetGroup{ID: 2, Targets: []Target{{Addr: "10.0.0.2:9100"}}}
+	if err := ts.Apply(10, &Command{Op: OpUpdateTargetGroup, TargetGroup: again}); err != nil {
+		t.Errorf("registering a revoked target again: %v", err)
+	}
+	if err := ts.Apply(11, &Command{Op: OpRevokeLease, LeaseID: 1}); err != ErrLeaseNotFound {
+		t.Errorf("revoking twice: err = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	if err := ts.Apply(12, &Command{Op: OpDeleteTargetGroup, GroupID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if l2, err := ts.GetLease(2); err != nil || len(l2.Targets) != 0 {
+		t.Errorf("lease 2 = %+v, %v, want no targets once its group is deleted", l2, err)
+	}
+}
+
+func TestTargetStoreTargetLabels(t *testing.T) {
+	ts := newTestTargetStore(t)
+	tg := &TargetGroup{
+		Labels: map[string]interface{}{"env": "prod"},
+		Targets: []Target{
+			{Addr: "node-a:9100", Labels: map[string]string{"rack": "r1"}},
+			{Addr: "node-b:9100"},
+		},
+	}
+	if err := ts.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ts.GetTargetGroup(tg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{
+		{ID: 1, Addr: "node-a:9100", Labels: map[string]string{"rack": "r1"}},
+		{ID: 2, Addr: "node-b:9100"},
+	}
+	if !reflect.DeepEqual(got.Targets, want) {
+		t.Errorf("targets = %+v, want %+v", got.Targets, want)
+	}
+}
+
+func TestTargetStoreDefaultPort(t *testing.T) {
+	ts := newTestTargetStore(t)
+	tg := &TargetGroup{DefaultPort: 9100, Targets: []Target{{Addr: "node-a:9100"}, {Addr: "node-a:9100"}}}
+	if err := ts.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != ErrTargetExists {
+		t.Errorf("creating a group with an address twice: err = %v, want %v", err, ErrTargetExists)
+	}
+	tg.Targets = tg.Targets[:1]
+	if err := ts.Apply(2, &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ts.GetTargetGroup(tg.ID); err != nil || got.DefaultPort != 9100 {
+		t.Errorf("GetTargetGroup = %+v, %v, want default port 9100", got, err)
+	}
+}
+
+func TestTargetStoreAddrIndex(t *testing.T) {
+	ts := newTestTargetStore(t)
+	addrs := []string{"10.0.0.1:9100", "10.0.0.2:9100", "10.0.0.3:9100"}
+	for i := 0; i < 2; i++ {
+		tg := &TargetGroup{}
+		for _, addr := range addrs {
+			tg.Targets = append(tg.Targets, Target{Addr: addr})
+		}
+		if err := ts.Apply(uint64(i+1), &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tg, err := ts.GetTargetGroup(1); err != nil || len(tg.Targets) != len(addrs) {
+		t.Errorf("GetTargetGroup = %+v, %v, want %d targets", tg, err, len(addrs))
+	}
+	addrGroups := func(addr string) []uint64 {
+		var groups []uint64
+		ts.db.View(func(tx *bolt.Tx) error {
+			var err error
+			groups, err = ts.addrGroups(tx, addr)
+			return err
+		})
+		return groups
+	}
+	if got := addrGroups("10.0.0.1:9100"); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("groups of 10.0.0.1:9100 = %v, want [1 2]", got)
+	}
+
+	// a deleted address can be added again
+	if err := ts.Apply(3, &Command{Op: OpDeleteTarget, GroupID: 1, TargetID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := addrGroups("10.0.0.1:9100"); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Errorf("groups of 10.0.0.1:9100 after deleting it from group 1 = %v, want [2]", got)
+	}
+	again := &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.1:9100"}}}
+	if err := ts.Apply(4, &Command{Op: OpUpdateTargetGroup, TargetGroup: again}); err != nil {
+		t.Errorf("adding a deleted address again: %v", err)
+	}
+
+	if err := ts.Apply(5, &Command{Op: OpDeleteTargetGroup, GroupID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := addrGroups("10.0.0.2:9100"); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Errorf("groups of 10.0.0.2:9100 after deleting group 2 = %v, want [1]", got)
+	}
+}
+
+func TestTargetStoreMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "httpsd.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the layout before the indexes: IDs and addresses in one bucket, and
+	// the address of deleted target 2 left behind
+	err = db.Update(func(tx *bolt.Tx) error {
+		root, _ := tx.CreateBucketIfNotExists([]byte("root"))
+		tgiBkt, _ := root.CreateBucket([]byte("TargetGroup"))
+		tgiBkt, _ = tgiBkt.CreateBucket([]byte("1"))
+		tgiBkt.Put([]byte("label"), []byte(`{"env":"prod"}`))
+		tBkt, _ := tgiBkt.CreateBucket([]byte("target"))
+		for k, v := range map[string]string{
+			"1": "10.0.0.1:9100", "10.0.0.1:9100": "1",
+			"10.0.0.2:9100": "2",
+			"3":             "10.0.0.3:9100", "10.0.0.3:9100": "3",
+		} {
+			if err := tBkt.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	tg, err := ts.GetTargetGroup(1)
+	want := []Target{{ID: 1, Addr: "10.0.0.1:9100"}, {ID: 3, Addr: "10.0.0.3:9100"}}
+	if err != nil || !reflect.DeepEqual(tg.Targets, want) {
+		t.Errorf("GetTargetGroup = %+v, %v, want targets %+v", tg, err, want)
+	}
+	again := &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.2:9100"}}}
+	if err := ts.Apply(1, &Command{Op: OpUpdateTargetGroup, TargetGroup: again}); err != nil {
+		t.Errorf("adding the stale address again: %v", err)
+	}
+	if err := ts.Apply(2, &Command{Op: OpUpdateTargetGroup, TargetGroup: &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.3:9100"}}}}); err != ErrTargetExists {
+		t.Errorf("adding an indexed address again: err = %v, want %v", err, ErrTargetExists)
+	}
+}
+
+func TestTargetStoreFindByAddress(t *testing.T) {
+	ts := newTestTargetStore(t)
+	groups := []*TargetGroup{
+		{Labels: map[string]interface{}{"env": "prod"}, Targets: []Target{{Addr: "10.0.0.2:9100"}, {Addr: "10.0.0.1:9100", Labels: map[string]string{"rack": "r1"}}}},
+		{Labels: map[string]interface{}{"env": "dev"}, Targets: []Target{{Addr: "10.0.0.3:9100"}}},
+		{Labels: map[string]interface{}{"env": "test"}, Targets: []Target{{Addr: "10.0.0.1:9100"}}},
+	}
+	for i, tg := range groups {
+		if err := ts.Apply(uint64(i+1), &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ts.FindByAddress("10.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AddrMatch{
+		{GroupID: 1, TargetID: 2, Labels: map[string]interface{}{"env": "prod", "rack": "r1"}, GroupLabels: map[string]interface{}{"env": "prod"}},
+		{GroupID: 3, TargetID: 1, Labels: map[string]interface{}{"env": "test"}, GroupLabels: map[string]interface{}{"env": "test"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindByAddress = %+v, want %+v", got, want)
+	}
+	if got, err := ts.FindByAddress("10.0.0.9:9100"); err != nil || len(got) != 0 {
+		t.Errorf("FindByAddress of an unknown address = %+v, %v, want none", got, err)
+	}
+}
+
+func TestTargetStoreTargetsByAddress(t *testing.T) {
+	ts := newTestTargetStore(t)
+	if err := ts.Apply(1, &Command{Op: OpGrantLease, Lease: &Lease{TTL: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	groups := []*TargetGroup{
+		{Targets: []Target{{Addr: "10.0.0.1:9100", LeaseID: 1, Labels: map[string]string{"rack": "r1"}}, {Addr: "10.0.0.2:9100"}}},
+		{Targets: []Target{{Addr: "10.0.0.2:9100"}}},
+		{Targets: []Target{{Addr: "10.0.0.3:9100"}}},
+	}
+	for i, tg := range groups {
+		if err := ts.Apply(uint64(i+2), &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	move := &Command{Op: OpMoveTarget, GroupID: 1, ToGroupID: 3, Addr: "10.0.0.1:9100"}
+	if err := ts.Apply(5, move); err != nil {
+		t.Fatal(err)
+	}
+	if move.TargetID != 2 {
+		t.Errorf("moved target ID = %d, want 2", move.TargetID)
+	}
+	tg, err := ts.GetTargetGroup(3)
+	want := Target{ID: 2, Addr: "10.0.0.1:9100", LeaseID: 1, Labels: map[string]string{"rack": "r1"}}
+	if err != nil || len(tg.Targets) != 2 || !reflect.DeepEqual(tg.Targets[1], want) {
+		t.Errorf("target group 3 = %+v, %v, want %+v moved to it", tg, err, want)
+	}
+	if l, err := ts.GetLease(1); err != nil || !reflect.DeepEqual(l.Targets, []LeaseTarget{{GroupID: 3, TargetID: 2}}) {
+		t.Errorf("lease 1 = %+v, %v, want the moved target", l, err)
+	}
+	if err := ts.Apply(6, &Command{Op: OpMoveTarget, GroupID: 1, ToGroupID: 2, Addr: "10.0.0.2:9100"}); err != ErrTargetExists {
+		t.Errorf("moving to a group with the address: err = %v, want %v", err, ErrTargetExists)
+	}
+
+	// the roles are those of the groups when the move is applied
+	editor := &Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, GroupID: 3}, {Role: RoleReader, GroupID: 2}}}
+	if err := ts.Apply(7, &Command{Op: OpMoveTarget, GroupID: 3, ToGroupID: 2, Addr: "10.0.0.1:9100", Auth: editor}); err != ErrForbidden {
+		t.Errorf("moving to a group the token reads: err = %v, want %v", err, ErrForbidden)
+	}
+
+	if err := ts.Apply(8, &Command{Op: OpDeleteTargetAddr, GroupID: 3, Addr: "10.0.0.3:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Apply(9, &Command{Op: OpDeleteTargetAddr, GroupID: 3, Addr: "10.0.0.3:9100"}); err != ErrTargetNotFound {
+		t.Errorf("deleting twice: err = %v, want %v", err, ErrTargetNotFound)
+	}
+
+	// group 2 got the address after only group 1 was authorized
+	if err := ts.Apply(10, &Command{Op: OpRemoveAddr, Addr: "10.0.0.2:9100", GroupIDs: []uint64{1}}); err != ErrAddrGroupsChanged {
+		t.Errorf("removing from unauthorized groups: err = %v, want %v", err, ErrAddrGroupsChanged)
+	}
+	remove := &Command{Op: OpRemoveAddr, Addr: "10.0.0.2:9100", GroupIDs: []uint64{1, 2, 3}}
+	if err := ts.Apply(11, remove); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remove.GroupIDs, []uint64{1, 2}) {
+		t.Errorf("removed from groups %v, want [1 2]", remove.GroupIDs)
+	}
+	if found, err := ts.FindByAddress("10.0.0.2:9100"); err != nil || len(found) != 0 {
+		t.Errorf("FindByAddress after removing = %+v, %v, want none", found, err)
+	}
+	for _, id := range []uint64{1, 2} {
+		if tg, err := ts.GetTargetGroup(id); err != nil || len(tg.Targets) != 0 {
+			t.Errorf("target group %d = %+v, %v, want no targets", id, tg, err)
+		}
+	}
+}
+
+func TestTargetStoreApplyForbidden(t *testing.T) {
+	ts := newTestTargetStore(t)
+	tg := &TargetGroup{Targets: []Target{{Addr: "10.0.0.1:9100"}}, Labels: map[string]interface{}{"team": "payments"}}
+	if err := ts.Apply(1, &Command{Op: OpCreateTargetGroup, TargetGroup: tg}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ts.GetTargetGroup(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the roles are those of the group when each command is applied
+	editor := &Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleEditor, Selector: map[string]string{"team": "payments"}}}}
+	reader := &Token{Scope: ScopeWrite, Grants: []Grant{{Role: RoleReader, GroupID: 1}}}
+	tests := []struct {
+		name string
+		cmd  Command
+	}{
+		{"create as editor", Command{Op: OpCreateTargetGroup, TargetGroup: &TargetGroup{Labels: map[string]interface{}{"team": "payments"}}, Auth: editor}},
+		{"update as reader", Command{Op: OpUpdateTargetGroup, TargetGroup: &TargetGroup{ID: 1, Targets: []Target{{Addr: "10.0.0.2:9100"}}}, Auth: reader}},
+		{"update out of the selector", Command{Op: OpUpdateTargetGroup, TargetGroup: &TargetGroup{ID: 1, Labels: map[string]interface{}{"team": "search"}}, Auth: editor}},
+		{"delete group as editor", Command{Op: OpDeleteTargetGroup, GroupID: 1, Auth: editor}},
+		{"delete target as reader", Command{Op: OpDeleteTarget, GroupID: 1, TargetID: 1, Auth: reader}},
+		{"delete address as reader", Command{Op: OpDeleteTargetAddr, GroupID: 1, Addr: "10.0.0.1:9100", Auth: reader}},
+		{"delete label as reader", Command{Op: OpDeleteLabel, GroupID: 1, LabelKey: "team", Auth: reader}},
+		{"delete label out of the selector", Command{Op: OpDeleteLabel, GroupID: 1, LabelKey: "team", Auth: editor}},
+	}
+	for i, tt := range tests {
+		cmd := tt.cmd
+		if err := ts.Apply(uint64(i+2), &cmd); err != ErrForbidden {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, ErrForbidden)
+		}
+	}
+	if got, err := ts.GetAllTargetGroups(); err != nil || len(got) != 1 || !reflect.DeepEqual(got[0], *want) {
+		t.Errorf("target groups = %+v, %v, want only %+v", got, err, want)
+	}
+}
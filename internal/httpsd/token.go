@@ -0,0 +1,155 @@
+package httpsd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Scope is what an API token grants. Scopes are ordered, each one grants
+// everything the previous ones do: discover < read < write < admin.
+type Scope string
+
+const (
+	// ScopeDiscover only grants the Prometheus discover endpoint.
+	ScopeDiscover Scope = "discover"
+	// ScopeRead grants reading target groups and the cluster state.
+	ScopeRead Scope = "read"
+	// ScopeWrite grants modifying target groups.
+	ScopeWrite Scope = "write"
+	// ScopeAdmin grants managing tokens and cluster members.
+	ScopeAdmin Scope = "admin"
+)
+
+var scopeLevels = map[Scope]int{ScopeDiscover: 1, ScopeRead: 2, ScopeWrite: 3, ScopeAdmin: 4}
+
+// Valid reports whether s is a known scope.
+func (s Scope) Valid() bool { return scopeLevels[s] > 0 }
+
+// Allows reports whether a token with scope s may do what requires required.
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && scopeLevels[s] >= scopeLevels[required]
+}
+
+// Token is an API bearer token. Only the SHA-256 hash of the secret is
+// stored, the secret itself is handed out once when the token is created.
+// Grants, if any, limit the token to the target groups they select.
+type Token struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scope     Scope     `json:"scope"`
+	Grants    []Grant   `json:"grants,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ErrTokenNotFound is returned when a token ID does not exist.
+var ErrTokenNotFound = errors.New("no such token")
+
+// HashToken returns the hash a token secret is stored and looked up by.
+// Secrets are random, so a plain SHA-256 is enough to keep them from
+// being recovered from the store.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//GetTokenByHash returns the token whose secret hashes to hash
+func (ts *TargetStore) GetTokenByHash(hash string) (*Token, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	var t *Token
+	ts.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(ts.rootBucket))
+		hashBkt, tokenBkt := root.Bucket([]byte("TokenHash")), root.Bucket([]byte("Token"))
+		if hashBkt == nil || tokenBkt == nil {
+			return nil
+		}
+		id := hashBkt.Get([]byte(hash))
+		if id == nil {
+			return nil
+		}
+		if v := tokenBkt.Get(id); v != nil {
+			t = &Token{}
+			return json.Unmarshal(v, t)
+		}
+		return nil
+	})
+	return t, t != nil
+}
+
+//GetTokens returns all tokens
+func (ts *TargetStore) GetTokens() ([]Token, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	defer observeTx("read", time.Now())
+	tokens := []Token{}
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ts.rootBucket)).Bucket([]byte("Token"))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			var t Token
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+//createToken stores a token and sets its ID
+func (ts *TargetStore) createToken(tx *bolt.Tx, t *Token) error {
+	root := tx.Bucket([]byte(ts.rootBucket))
+	tokenBkt, err := root.CreateBucketIfNotExists([]byte("Token"))
+	if err != nil {
+		return err
+	}
+	hashBkt, err := root.CreateBucketIfNotExists([]byte("TokenHash"))
+	if err != nil {
+		return err
+	}
+	if t.ID, err = tokenBkt.NextSequence(); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	id := []byte(strconv.FormatUint(t.ID, 10))
+	if err := tokenBkt.Put(id, buf); err != nil {
+		return err
+	}
+	return hashBkt.Put([]byte(t.Hash), id)
+}
+
+//deleteToken deletes a token, returns ErrTokenNotFound if it doesn't exist
+func (ts *TargetStore) deleteToken(tx *bolt.Tx, id uint64) error {
+	root := tx.Bucket([]byte(ts.rootBucket))
+	tokenBkt, hashBkt := root.Bucket([]byte("Token")), root.Bucket([]byte("TokenHash"))
+	if tokenBkt == nil || hashBkt == nil {
+		return ErrTokenNotFound
+	}
+	key := []byte(strconv.FormatUint(id, 10))
+	v := tokenBkt.Get(key)
+	if v == nil {
+		return ErrTokenNotFound
+	}
+	var t Token
+	if err := json.Unmarshal(v, &t); err != nil {
+		return err
+	}
+	if err := hashBkt.Delete([]byte(t.Hash)); err != nil {
+		return err
+	}
+	return tokenBkt.Delete(key)
+}
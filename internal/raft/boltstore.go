@@ -2,74 +2,156 @@ package raft
 
 import (
 	"encoding/binary"
-	"encoding/json"
-	"strconv"
+	"log"
 	"sync"
 
 	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/raft/v3"
 	pb "go.etcd.io/etcd/raft/v3/raftpb"
 )
 
+var (
+	entriesBucket = []byte("entries")
+	stateBucket   = []byte("state")
+
+	hardStateKey = []byte("hardstate")
+	snapshotKey  = []byte("snapshot")
+)
+
 // BoltStorage implements the Storage interface backed by an
-// boltdb
+// boltdb. Like raft.MemoryStorage the first entry of the log is a dummy
+// entry holding the index and term of the last compaction; entries are
+// keyed by their big endian encoded index so that they are kept in order.
 type BoltStorage struct {
+	// Protects access to all fields. Most methods of BoltStorage are
+	// run on the raft goroutine, but Append() is run on an application
+	// goroutine.
 	sync.Mutex
 	db *bolt.DB
 }
 
-func NewBoltStorage(db *bolt.DB) *BoltStorage {
-	return &BoltStorage{db: db}
+// NewBoltStorage creates a BoltStorage, initializing an empty log with
+// the dummy entry at term zero when db holds no raft state yet.
+func NewBoltStorage(db *bolt.DB) (*BoltStorage, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(stateBucket); err != nil {
+			return err
+		}
+		entsBkt, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		if k, _ := entsBkt.Cursor().First(); k == nil {
+			return putEntry(entsBkt, pb.Entry{})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
 }
 
-// InitialState returns the saved HardState and ConfState information.
-func (bs *BoltStorage) InitialState() (pb.HardState, pb.ConfState, error) {
-	return pb.HardState{}, pb.ConfState{}, nil
+func indexKey(i uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, i)
+	return k
 }
 
-func limitSize(ents []pb.Entry, maxSize uint64) []pb.Entry {
-	if len(ents) == 0 {
-		return ents
+func putEntry(bkt *bolt.Bucket, e pb.Entry) error {
+	v, err := e.Marshal()
+	if err != nil {
+		return err
 	}
-	size := ents[0].Size()
-	var limit int
-	for limit = 1; limit < len(ents); limit++ {
-		size += ents[limit].Size()
-		if uint64(size) > maxSize {
-			break
+	return bkt.Put(indexKey(e.Index), v)
+}
+
+func unmarshalEntry(v []byte) pb.Entry {
+	var e pb.Entry
+	if err := e.Unmarshal(v); err != nil {
+		panic(err) // the log is corrupted
+	}
+	return e
+}
+
+// dummyAndLast returns the first entry of the log, which marks the
+// compaction point, and the last entry of the log.
+func dummyAndLast(bkt *bolt.Bucket) (pb.Entry, pb.Entry) {
+	c := bkt.Cursor()
+	_, first := c.First()
+	_, last := c.Last()
+	return unmarshalEntry(first), unmarshalEntry(last)
+}
+
+// InitialState returns the saved HardState and ConfState information.
+func (bs *BoltStorage) InitialState() (pb.HardState, pb.ConfState, error) {
+	var hs pb.HardState
+	var snap pb.Snapshot
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		stBkt := tx.Bucket(stateBucket)
+		if v := stBkt.Get(hardStateKey); v != nil {
+			if err := hs.Unmarshal(v); err != nil {
+				return err
+			}
+		}
+		if v := stBkt.Get(snapshotKey); v != nil {
+			return snap.Unmarshal(v)
 		}
+		return nil
+	})
+	return hs, snap.Metadata.ConfState, err
+}
+
+// SetHardState saves the current HardState.
+func (bs *BoltStorage) SetHardState(st pb.HardState) error {
+	bs.Lock()
+	defer bs.Unlock()
+	v, err := st.Marshal()
+	if err != nil {
+		return err
 	}
-	return ents[:limit]
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(hardStateKey, v)
+	})
 }
 
 // Entries returns a slice of log entries in the range [lo,hi).
 // MaxSize limits the total size of the log entries returned, but
 // Entries returns at least one entry if any.
 func (bs *BoltStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
-	tx, err := bs.db.Begin(true)
-	if err != nil {
-		return []pb.Entry{}, err
-	}
-	defer tx.Rollback()
-	entsBkt := tx.Bucket([]byte("entries"))
-
-	ents := make([]pb.Entry, 0)
-	entsBkt.ForEach(func(k, v []byte) error {
-		i, _ := strconv.ParseUint(string(k), 10, 64)
-		if i >= lo && i < hi {
-			var en map[string]interface{}
-			json.Unmarshal(v, &en)
-			entry := pb.Entry{
-				Term:  en["Term"].(uint64),
-				Index: en["Index"].(uint64),
-				Type:  pb.EntryType(en["Type"].(int)),
-				Data:  en["Data"].([]byte),
+	bs.Lock()
+	defer bs.Unlock()
+	var ents []pb.Entry
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		entsBkt := tx.Bucket(entriesBucket)
+		dummy, last := dummyAndLast(entsBkt)
+		if lo <= dummy.Index {
+			return raft.ErrCompacted
+		}
+		if hi > last.Index+1 {
+			log.Panicf("entries' hi(%d) is out of bound lastindex(%d)", hi, last.Index)
+		}
+		// only contains dummy entries.
+		if dummy.Index == last.Index {
+			return raft.ErrUnavailable
+		}
+
+		var size uint64
+		c := entsBkt.Cursor()
+		for k, v := c.Seek(indexKey(lo)); k != nil && binary.BigEndian.Uint64(k) < hi; k, v = c.Next() {
+			e := unmarshalEntry(v)
+			size += uint64(e.Size())
+			if len(ents) > 0 && size > maxSize {
+				break
 			}
-			ents = append(ents, entry)
+			ents = append(ents, e)
 		}
 		return nil
 	})
-
-	return limitSize(ents, maxSize), nil
+	if err != nil {
+		return nil, err
+	}
+	return ents, nil
 }
 
 // Term returns the term of entry i, which must be in the range
@@ -77,36 +159,36 @@ func (bs *BoltStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
 // FirstIndex is retained for matching purposes even though the
 // rest of that entry may not be available.
 func (bs *BoltStorage) Term(i uint64) (uint64, error) {
-	tx, err := bs.db.Begin(true)
-	if err != nil {
-		return 0, err
-	}
-	defer tx.Rollback()
-	entsBkt := tx.Bucket([]byte("entries"))
-	buf := make([]byte, binary.MaxVarintLen64)
-	binary.PutUvarint(buf, i)
-	ent := entsBkt.Get(buf)
-	if ent != nil {
-		var e pb.Entry
-		json.Unmarshal(ent, &e)
-		return e.Term, nil
-	}
-
-	return 0, nil
+	bs.Lock()
+	defer bs.Unlock()
+	var term uint64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		entsBkt := tx.Bucket(entriesBucket)
+		dummy, _ := dummyAndLast(entsBkt)
+		if i < dummy.Index {
+			return raft.ErrCompacted
+		}
+		v := entsBkt.Get(indexKey(i))
+		if v == nil {
+			return raft.ErrUnavailable
+		}
+		term = unmarshalEntry(v).Term
+		return nil
+	})
+	return term, err
 }
 
 // LastIndex returns the index of the last entry in the log.
 func (bs *BoltStorage) LastIndex() (uint64, error) {
-	tx, err := bs.db.Begin(true)
-	if err != nil {
-		return 0, err
-	}
-	defer tx.Rollback()
-	entsBkt := tx.Bucket([]byte("entries"))
-	_, v := entsBkt.Cursor().Last()
-	var lastEntry pb.Entry
-	json.Unmarshal(v, &lastEntry)
-	return lastEntry.Index, nil
+	bs.Lock()
+	defer bs.Unlock()
+	var index uint64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		_, last := dummyAndLast(tx.Bucket(entriesBucket))
+		index = last.Index
+		return nil
+	})
+	return index, err
 }
 
 // FirstIndex returns the index of the first log entry that is
@@ -114,16 +196,15 @@ func (bs *BoltStorage) LastIndex() (uint64, error) {
 // into the latest Snapshot; if storage only contains the dummy entry the
 // first log entry is not available).
 func (bs *BoltStorage) FirstIndex() (uint64, error) {
-	tx, err := bs.db.Begin(true)
-	if err != nil {
-		return 0, err
-	}
-	defer tx.Rollback()
-	entsBkt := tx.Bucket([]byte("entries"))
-	_, v := entsBkt.Cursor().First()
-	var firstEntry pb.Entry
-	json.Unmarshal(v, &firstEntry)
-	return firstEntry.Index, nil
+	bs.Lock()
+	defer bs.Unlock()
+	var index uint64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		dummy, _ := dummyAndLast(tx.Bucket(entriesBucket))
+		index = dummy.Index + 1
+		return nil
+	})
+	return index, err
 }
 
 // Snapshot returns the most recent snapshot.
@@ -131,5 +212,163 @@ func (bs *BoltStorage) FirstIndex() (uint64, error) {
 // so raft state machine could know that Storage needs some time to prepare
 // snapshot and call Snapshot later.
 func (bs *BoltStorage) Snapshot() (pb.Snapshot, error) {
-	return pb.Snapshot{}, nil
+	bs.Lock()
+	defer bs.Unlock()
+	var snap pb.Snapshot
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		snap = bs.snapshot(tx)
+		return nil
+	})
+	return snap, err
+}
+
+func (bs *BoltStorage) snapshot(tx *bolt.Tx) pb.Snapshot {
+	var snap pb.Snapshot
+	if v := tx.Bucket(stateBucket).Get(snapshotKey); v != nil {
+		if err := snap.Unmarshal(v); err != nil {
+			panic(err)
+		}
+	}
+	return snap
+}
+
+func (bs *BoltStorage) putSnapshot(tx *bolt.Tx, snap pb.Snapshot) error {
+	v, err := snap.Marshal()
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(stateBucket).Put(snapshotKey, v)
+}
+
+// ApplySnapshot overwrites the contents of this Storage object with
+// those of the given snapshot.
+func (bs *BoltStorage) ApplySnapshot(snap pb.Snapshot) error {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		//handle check for old snapshot being applied
+		if bs.snapshot(tx).Metadata.Index >= snap.Metadata.Index {
+			return raft.ErrSnapOutOfDate
+		}
+		if err := bs.putSnapshot(tx, snap); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(entriesBucket); err != nil {
+			return err
+		}
+		entsBkt, err := tx.CreateBucket(entriesBucket)
+		if err != nil {
+			return err
+		}
+		return putEntry(entsBkt, pb.Entry{Term: snap.Metadata.Term, Index: snap.Metadata.Index})
+	})
+}
+
+// CreateSnapshot makes a snapshot which can be retrieved with Snapshot() and
+// can be used to reconstruct the state at that point.
+// If any configuration changes have been made since the last compaction,
+// the result of the last ApplyConfChange must be passed in.
+func (bs *BoltStorage) CreateSnapshot(i uint64, cs *pb.ConfState, data []byte) (pb.Snapshot, error) {
+	bs.Lock()
+	defer bs.Unlock()
+	var snap pb.Snapshot
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		snap = bs.snapshot(tx)
+		if i <= snap.Metadata.Index {
+			return raft.ErrSnapOutOfDate
+		}
+		entsBkt := tx.Bucket(entriesBucket)
+		_, last := dummyAndLast(entsBkt)
+		if i > last.Index {
+			log.Panicf("snapshot %d is out of bound lastindex(%d)", i, last.Index)
+		}
+		v := entsBkt.Get(indexKey(i))
+		if v == nil {
+			log.Panicf("snapshot %d is older than the compacted log", i)
+		}
+
+		snap.Metadata.Index = i
+		snap.Metadata.Term = unmarshalEntry(v).Term
+		if cs != nil {
+			snap.Metadata.ConfState = *cs
+		}
+		snap.Data = data
+		return bs.putSnapshot(tx, snap)
+	})
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	return snap, nil
+}
+
+// Compact discards all log entries prior to compactIndex.
+// It is the application's responsibility to not attempt to compact an index
+// greater than raftLog.applied.
+func (bs *BoltStorage) Compact(compactIndex uint64) error {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		entsBkt := tx.Bucket(entriesBucket)
+		dummy, last := dummyAndLast(entsBkt)
+		if compactIndex <= dummy.Index {
+			return raft.ErrCompacted
+		}
+		if compactIndex > last.Index {
+			log.Panicf("compact %d is out of bound lastindex(%d)", compactIndex, last.Index)
+		}
+
+		// the entry at compactIndex becomes the new dummy entry
+		e := unmarshalEntry(entsBkt.Get(indexKey(compactIndex)))
+		c := entsBkt.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < compactIndex; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return putEntry(entsBkt, pb.Entry{Index: e.Index, Term: e.Term})
+	})
+}
+
+// Append the new entries to storage, replacing any conflicting entries
+// already in the log.
+func (bs *BoltStorage) Append(entries []pb.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		entsBkt := tx.Bucket(entriesBucket)
+		dummy, lastEnt := dummyAndLast(entsBkt)
+		first := dummy.Index + 1
+		last := entries[0].Index + uint64(len(entries)) - 1
+
+		// shortcut if there is no new entry.
+		if last < first {
+			return nil
+		}
+		// truncate compacted entries
+		if first > entries[0].Index {
+			entries = entries[first-entries[0].Index:]
+		}
+		if entries[0].Index > lastEnt.Index+1 {
+			log.Panicf("missing log entry [last: %d, append at: %d]",
+				lastEnt.Index, entries[0].Index)
+		}
+
+		// drop the conflicting suffix of the log
+		c := entsBkt.Cursor()
+		for k, _ := c.Seek(indexKey(entries[0].Index)); k != nil; k, _ = c.Seek(indexKey(entries[0].Index)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		for _, e := range entries {
+			if err := putEntry(entsBkt, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"crypto/tls"
 	"io"
 	"log"
 	"net/http"
@@ -8,7 +9,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/momirjalili/httpsd/internal/api"
-	bolt "go.etcd.io/bbolt"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 )
 
@@ -30,10 +33,13 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.store.Propose(key, string(v))
-
-		// Optimistic-- no waiting for ack from raft. Value is not yet
-		// committed so a subsequent GET on the key may return old value
+		// blocks until the value is committed and applied, so a
+		// subsequent GET on the key returns the new value
+		if err := h.store.Propose(r.Context(), key, string(v)); err != nil {
+			log.Printf("Failed to apply PUT (%v)\n", err)
+			http.Error(w, "Failed on PUT", http.StatusGatewayTimeout)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet:
 		if v, ok := h.store.Lookup(key); ok {
@@ -111,29 +117,85 @@ func ServeHttpKVAPI(kv *KVStore, port int, confChangeC chan<- raftpb.ConfChange,
 	}
 }
 
-// serveHttpSDAPI starts a key-value server with a GET/PUT API and listens.
-func ServeHttpSDAPI() {
-
+// NewHttpSDServer returns the service discovery API server backed by the
+// raft replicated target store, listening on addr once started. Writes
+// reaching a follower are forwarded to the leader according to forward.
+// If tlsInfo is not empty the server has a TLSConfig and must be started
+// with ListenAndServeTLS("", ""). A non-nil auth requires bearer tokens,
+// which are stored in store.
+func NewHttpSDServer(store *SDStore, addr string, forward api.ForwardMode, tlsInfo transport.TLSInfo, auth *api.AuthConfig) (*http.Server, error) {
 	router := mux.NewRouter()
 	router.StrictSlash(true)
-	// db, err := storm.Open("my.db", storm.Codec(gob.Codec))
-	db, err := bolt.Open("my.db", 0600, nil)
-	if err != nil {
-		log.Fatal(err)
+	server := api.NewSDServer(store, store, forward)
+	var tlsConfig *tls.Config
+	if !tlsInfo.Empty() {
+		var err error
+		if tlsConfig, err = tlsInfo.ServerConfig(); err != nil {
+			return nil, err
+		}
+		clientConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		server.ForwardTransport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: clientConfig,
+		}
 	}
-	defer db.Close()
-	server := api.NewSDServer(db)
-
-	router.HandleFunc("/api/v1/target/", server.GetAllTargetGroupsHandler).Methods("GET")
-	router.HandleFunc("/api/v1/target/", server.CreateTargetGroupHandler).Methods("POST")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", server.GetTargetGroupHandler).Methods("GET")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", server.PutTargetGroupHandler).Methods("PUT")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", server.DeleteTargetGroupHandler).Methods("DELETE")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/label/{label_key}", server.PatchTargetGroupLabelHandler).Methods("PATCH")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/label/{label_key}", server.DeleteTargetGroupLabelHandler).Methods("DELETE")
-	router.HandleFunc("/api/v1/target/{id:[0-9]+}/instance/{instance_id}", server.DeleteTargetGroupTargetHandler).Methods("DELETE")
-	router.HandleFunc("/api/v1/discover", server.DiscoverHandler)
-	http.ListenAndServe(":8080", router)
+	if auth != nil {
+		auth.Tokens = store
+		server.EnableAuth(*auth)
+	}
+	router.Use(api.Instrument)
+	leader := server.ForwardToLeader
+	discover := func(h http.HandlerFunc) http.HandlerFunc { return server.Authorize(httpsd.ScopeDiscover, h) }
+	read := func(h http.HandlerFunc) http.HandlerFunc { return server.Authorize(httpsd.ScopeRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return server.Authorize(httpsd.ScopeWrite, leader(h)) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return server.Authorize(httpsd.ScopeAdmin, leader(h)) }
+
+	router.HandleFunc("/api/v1/target/", read(server.GetAllTargetGroupsHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/target/", write(server.CreateTargetGroupHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", read(server.GetTargetGroupHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", write(server.PutTargetGroupHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/", write(server.DeleteTargetGroupHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/label/{label_key}", write(server.PatchTargetGroupLabelHandler)).Methods("PATCH")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/label/{label_key}", write(server.DeleteTargetGroupLabelHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/instance/{instance_id}", write(server.DeleteTargetGroupTargetHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/instance", write(server.DeleteTargetAddrHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/target/{id:[0-9]+}/move", write(server.MoveTargetHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/targets", read(server.FindTargetsHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/targets", write(server.RemoveAddrHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/discover", discover(server.DiscoverHandler))
+	router.HandleFunc("/api/v1/discover/{job}", discover(server.JobDiscoverHandler)).Methods("GET")
+
+	router.HandleFunc("/api/v1/jobs", read(server.ListJobsHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/jobs/{job}", read(server.GetJobHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/jobs/{job}", write(server.PutJobHandler)).Methods("PUT")
+	router.HandleFunc("/api/v1/jobs/{job}", write(server.DeleteJobHandler)).Methods("DELETE")
+
+	router.HandleFunc("/api/v1/leases", read(server.ListLeasesHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/leases", write(server.GrantLeaseHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/leases/{lease_id:[0-9]+}", read(server.GetLeaseHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/leases/{lease_id:[0-9]+}", write(server.RevokeLeaseHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/leases/{lease_id:[0-9]+}/keepalive", write(server.KeepAliveLeaseHandler)).Methods("POST")
+
+	router.HandleFunc("/api/v1/cluster/status", read(server.ClusterStatusHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/cluster/members", read(server.ListMembersHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/cluster/members", admin(server.AddMemberHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/cluster/members/{member_id:[0-9]+}", admin(server.RemoveMemberHandler)).Methods("DELETE")
+	router.HandleFunc("/api/v1/cluster/members/{member_id:[0-9]+}/promote", admin(server.PromoteMemberHandler)).Methods("POST")
+
+	router.Handle("/metrics", read(promhttp.Handler().ServeHTTP)).Methods("GET")
+	router.HandleFunc("/healthz", server.HealthzHandler).Methods("GET")
+	router.HandleFunc("/readyz", server.ReadyzHandler).Methods("GET")
+
+	router.HandleFunc("/api/v1/tokens", server.Authorize(httpsd.ScopeAdmin, server.ListTokensHandler)).Methods("GET")
+	router.HandleFunc("/api/v1/tokens", admin(server.CreateTokenHandler)).Methods("POST")
+	router.HandleFunc("/api/v1/tokens/{token_id:[0-9]+}", admin(server.DeleteTokenHandler)).Methods("DELETE")
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}, nil
 }
-
-// func getOrCreateDB() {}
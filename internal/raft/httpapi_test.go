@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/momirjalili/httpsd/internal/api"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+)
+
+// serveAPI sends a request to the API of node n and returns the recorded
+// response.
+func serveAPI(t *testing.T, n *sdNode, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	srv, err := NewHttpSDServer(n.SDStore, "127.0.0.1:0", api.ForwardProxy, transport.TLSInfo{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDiscoverReplicated(t *testing.T) {
+	nodes := startSDCluster(t, 3, 9041)
+	ctx, cancel := testContext()
+	defer cancel()
+	tg := &httpsd.TargetGroup{Labels: map[string]interface{}{"job": "node"}, Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}}
+	if _, err := nodes[0].CreateTargetGroup(ctx, tg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	type group struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}
+	want := []group{{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node"}}}
+	for _, n := range nodes[1:] {
+		rec := serveAPI(t, n, "GET", "/api/v1/discover?consistency=linearizable", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("discover on node %d = %d %q", n.node.ID(), rec.Code, rec.Body)
+		}
+		var got []group
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("discover on node %d = %+v, want %+v", n.node.ID(), got, want)
+		}
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+	nodes := startSDCluster(t, 3, 9081)
+	ctx, cancel := testContext()
+	defer cancel()
+	// a command is applied once a leader is elected
+	if _, err := nodes[0].CreateTargetGroup(ctx, &httpsd.TargetGroup{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var leader uint64
+	for _, n := range nodes {
+		if n.IsLeader() {
+			leader = n.node.ID()
+		}
+	}
+	if leader == 0 {
+		t.Fatal("no node leads")
+	}
+
+	for _, n := range nodes {
+		if err := n.LinearizableRead(ctx); err != nil {
+			t.Fatal(err)
+		}
+		rec := serveAPI(t, n, "GET", "/api/v1/cluster/status", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status of node %d = %d %q", n.node.ID(), rec.Code, rec.Body)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		for _, k := range []string{"id", "leader", "raft_state", "term", "vote", "commit_index", "applied_index", "store_applied_index", "snapshot_index", "wal_dir", "snap_dir", "server_stats"} {
+			if _, ok := fields[k]; !ok {
+				t.Errorf("status of node %d has no %s: %s", n.node.ID(), k, rec.Body)
+			}
+		}
+		var st api.ClusterStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		if st.ID != n.node.ID() || st.Leader != leader || st.Term == 0 || st.CommitIndex == 0 || st.StoreAppliedIndex == 0 {
+			t.Errorf("status of node %d = %+v, want it led by %d past index 0", n.node.ID(), st, leader)
+		}
+
+		// only the leader tracks the progress of the followers
+		if n.node.ID() == leader {
+			_, hasStats := fields["leader_stats"]
+			if st.RaftState != "StateLeader" || len(st.Progress) != 3 || !hasStats {
+				t.Errorf("status of leader %d = %s, want the state, progress and stats of a leader", n.node.ID(), rec.Body)
+			}
+		} else if st.RaftState != "StateFollower" || st.Progress != nil {
+			t.Errorf("status of follower %d = %s, want the state of a follower without progress", n.node.ID(), rec.Body)
+		}
+	}
+}
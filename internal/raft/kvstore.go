@@ -16,6 +16,7 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"log"
@@ -28,18 +29,20 @@ import (
 // a key-value store backed by raft
 type KVStore struct {
 	proposeC    chan<- string // channel for proposing updates
+	tracker     *proposalTracker
 	mu          sync.RWMutex
 	kvStore     map[string]string // current committed key-value pairs
 	snapshotter *snap.Snapshotter
 }
 
 type kv struct {
+	ID  uint64 // request ID of the proposal
 	Key string
 	Val string
 }
 
-func NewKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *commit, errorC <-chan error) *KVStore {
-	s := &KVStore{proposeC: proposeC, kvStore: make(map[string]string), snapshotter: snapshotter}
+func NewKVStore(id int, snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *commit, errorC <-chan error) *KVStore {
+	s := &KVStore{proposeC: proposeC, tracker: newProposalTracker(id), kvStore: make(map[string]string), snapshotter: snapshotter}
 	snapshot, err := s.loadSnapshot()
 	if err != nil {
 		log.Panic(err)
@@ -62,12 +65,16 @@ func (s *KVStore) Lookup(key string) (string, bool) {
 	return v, ok
 }
 
-func (s *KVStore) Propose(k string, v string) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(kv{k, v}); err != nil {
-		log.Fatal(err)
-	}
-	s.proposeC <- buf.String()
+// Propose proposes setting k to v and waits until the update is applied.
+func (s *KVStore) Propose(ctx context.Context, k string, v string) error {
+	_, err := s.tracker.propose(ctx, s.proposeC, func(reqID uint64) (string, error) {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(kv{reqID, k, v}); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	})
+	return err
 }
 
 func (s *KVStore) readCommits(commitC <-chan *commit, errorC <-chan error) {
@@ -96,6 +103,7 @@ func (s *KVStore) readCommits(commitC <-chan *commit, errorC <-chan error) {
 			s.mu.Lock()
 			s.kvStore[dataKv.Key] = dataKv.Val
 			s.mu.Unlock()
+			s.tracker.trigger(dataKv.ID, nil)
 		}
 		close(commit.applyDoneC)
 	}
@@ -0,0 +1,134 @@
+package raft
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// leaseCheckInterval is how often the leader looks for expired leases.
+var leaseCheckInterval = 500 * time.Millisecond
+
+// lessor tracks when leases expire. Grants and revocations are replicated,
+// keep-alives are not: only the leader's expiry times count. A node that
+// becomes leader extends every lease by its TTL, so that leases are not
+// lost to the time it took to elect it.
+type lessor struct {
+	mu       sync.Mutex
+	ttl      map[uint64]time.Duration
+	expiry   map[uint64]time.Time
+	revoking map[uint64]bool // revocations proposed and not applied yet
+	primary  bool            // whether the expiry times are this leader's
+}
+
+func newLessor() *lessor {
+	return &lessor{
+		ttl:      map[uint64]time.Duration{},
+		expiry:   map[uint64]time.Time{},
+		revoking: map[uint64]bool{},
+	}
+}
+
+// reset replaces the tracked leases with those of the store, e.g. after
+// a snapshot was restored.
+func (le *lessor) reset(leases []httpsd.Lease) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.ttl = map[uint64]time.Duration{}
+	le.expiry = map[uint64]time.Time{}
+	le.revoking = map[uint64]bool{}
+	now := time.Now()
+	for _, l := range leases {
+		le.ttl[l.ID] = l.TTLDuration()
+		le.expiry[l.ID] = now.Add(l.TTLDuration())
+	}
+}
+
+func (le *lessor) grant(l *httpsd.Lease) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.ttl[l.ID] = l.TTLDuration()
+	le.expiry[l.ID] = time.Now().Add(l.TTLDuration())
+}
+
+func (le *lessor) revoke(id uint64) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	delete(le.ttl, id)
+	delete(le.expiry, id)
+	delete(le.revoking, id)
+}
+
+// renew extends a lease by its TTL and returns the TTL.
+func (le *lessor) renew(id uint64) (time.Duration, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	ttl, ok := le.ttl[id]
+	if !ok || le.revoking[id] {
+		return 0, httpsd.ErrLeaseNotFound
+	}
+	le.expiry[id] = time.Now().Add(ttl)
+	return ttl, nil
+}
+
+// expired returns the leases to revoke, if this node leads, and marks them
+// as being revoked.
+func (le *lessor) expired(leader bool) []uint64 {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if !leader {
+		le.primary = false
+		return nil
+	}
+	now := time.Now()
+	if !le.primary {
+		le.primary = true
+		for id, ttl := range le.ttl {
+			le.expiry[id] = now.Add(ttl)
+		}
+		le.revoking = map[uint64]bool{}
+		return nil
+	}
+	var ids []uint64
+	for id, t := range le.expiry {
+		if now.After(t) && !le.revoking[id] {
+			le.revoking[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// forget lets a failed revocation be proposed again.
+func (le *lessor) forget(id uint64) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	delete(le.revoking, id)
+}
+
+// expireLeases proposes the revocation of expired leases while this node
+// leads, until the store stops.
+func (s *SDStore) expireLeases() {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.donec:
+			return
+		}
+		for _, id := range s.lessor.expired(s.IsLeader()) {
+			go func(id uint64) {
+				if err := s.RevokeLease(context.Background(), id, nil); err != nil && err != httpsd.ErrLeaseNotFound {
+					log.Printf("httpsd: revoking expired lease %d failed (%v)", id, err)
+					s.lessor.forget(id)
+					return
+				}
+				log.Printf("httpsd: lease %d expired", id)
+			}(id)
+		}
+	}
+}
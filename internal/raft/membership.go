@@ -0,0 +1,136 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+)
+
+// Member is a voter or learner of the raft cluster.
+type Member struct {
+	ID        uint64   `json:"id"`
+	PeerURLs  []string `json:"peer_urls"`
+	IsLearner bool     `json:"is_learner"`
+}
+
+// confChangeContext is carried in the context of the conf changes proposed
+// by AddMember. Conf changes proposed through confChangeC carry the bare
+// peer URL instead.
+type confChangeContext struct {
+	PeerURLs []string `json:"peer_urls"`
+}
+
+func peerURLsFromContext(ctx []byte) []string {
+	if len(ctx) == 0 {
+		return nil
+	}
+	if bytes.HasPrefix(ctx, []byte("{")) {
+		var cc confChangeContext
+		if err := json.Unmarshal(ctx, &cc); err == nil {
+			return cc.PeerURLs
+		}
+	}
+	return []string{string(ctx)}
+}
+
+func (rc *raftNode) setConfState(cs raftpb.ConfState) {
+	rc.membersMu.Lock()
+	defer rc.membersMu.Unlock()
+	rc.confState = cs
+}
+
+func (rc *raftNode) setPeerURLs(id uint64, urls []string) {
+	rc.membersMu.Lock()
+	defer rc.membersMu.Unlock()
+	if urls == nil {
+		delete(rc.peerURLs, id)
+		return
+	}
+	rc.peerURLs[id] = urls
+}
+
+func (rc *raftNode) Members() []Member {
+	rc.membersMu.RLock()
+	defer rc.membersMu.RUnlock()
+	members := make([]Member, 0, len(rc.confState.Voters)+len(rc.confState.Learners))
+	for _, id := range rc.confState.Voters {
+		members = append(members, Member{ID: id, PeerURLs: rc.peerURLs[id]})
+	}
+	for _, id := range rc.confState.Learners {
+		members = append(members, Member{ID: id, PeerURLs: rc.peerURLs[id], IsLearner: true})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// member returns the current member with the given ID.
+func (rc *raftNode) member(id uint64) (Member, bool) {
+	for _, m := range rc.Members() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+func (rc *raftNode) AddMember(ctx context.Context, m Member) error {
+	if _, ok := rc.member(m.ID); ok {
+		return httpsd.ErrMemberExists
+	}
+	cctx, err := json.Marshal(confChangeContext{PeerURLs: m.PeerURLs})
+	if err != nil {
+		return err
+	}
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: m.ID, Context: cctx}
+	if m.IsLearner {
+		cc.Type = raftpb.ConfChangeAddLearnerNode
+	}
+	return rc.proposeConfChange(ctx, cc)
+}
+
+func (rc *raftNode) RemoveMember(ctx context.Context, id uint64) error {
+	if _, ok := rc.member(id); !ok {
+		return httpsd.ErrMemberNotFound
+	}
+	return rc.proposeConfChange(ctx, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id})
+}
+
+func (rc *raftNode) PromoteMember(ctx context.Context, id uint64) error {
+	m, ok := rc.member(id)
+	if !ok {
+		return httpsd.ErrMemberNotFound
+	}
+	if !m.IsLearner {
+		return httpsd.ErrMemberNotLearner
+	}
+	cctx, err := json.Marshal(confChangeContext{PeerURLs: m.PeerURLs})
+	if err != nil {
+		return err
+	}
+	return rc.proposeConfChange(ctx, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: id, Context: cctx})
+}
+
+// proposeConfChange proposes cc and blocks until it is applied. Raft drops
+// a conf change while another one is pending, in which case this times out.
+func (rc *raftNode) proposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	cc.ID = rc.reqIDGen.Next()
+	ch := rc.confWait.Register(cc.ID)
+	if err := rc.node.ProposeConfChange(ctx, cc); err != nil {
+		rc.confWait.Trigger(cc.ID, nil) // GC wait
+		return err
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		rc.confWait.Trigger(cc.ID, nil) // GC wait
+		return ctx.Err()
+	case <-rc.stopc:
+		return raft.ErrStopped
+	}
+}
@@ -0,0 +1,54 @@
+package raft
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	proposalsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "proposals_pending",
+		Help:      "Number of proposals waiting to be applied.",
+	})
+	proposalsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "proposals_failed_total",
+		Help:      "Number of proposals that were not applied in time.",
+	})
+	applyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "apply_duration_seconds",
+		Help:      "Time to apply a committed command to the target store.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	leaderChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "leader_changes_seen_total",
+		Help:      "Number of leader changes seen.",
+	})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "is_leader",
+		Help:      "Whether this member is the leader, 1 if it is and 0 otherwise.",
+	})
+	snapshots = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpsd",
+		Subsystem: "raft",
+		Name:      "snapshots_total",
+		Help:      "Number of snapshots taken by this member or received from the leader.",
+	}, []string{"origin"})
+)
+
+func init() {
+	prometheus.MustRegister(proposalsPending)
+	prometheus.MustRegister(proposalsFailed)
+	prometheus.MustRegister(applyDuration)
+	prometheus.MustRegister(leaderChanges)
+	prometheus.MustRegister(isLeader)
+	prometheus.MustRegister(snapshots)
+	snapshots.WithLabelValues("local")
+	snapshots.WithLabelValues("leader")
+}
@@ -16,16 +16,25 @@ package raft
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	bolt "go.etcd.io/bbolt"
 	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/pkg/v3/idutil"
+	"go.etcd.io/etcd/pkg/v3/wait"
 	"go.etcd.io/etcd/raft/v3"
 	"go.etcd.io/etcd/raft/v3/raftpb"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/rafthttp"
@@ -39,6 +48,7 @@ import (
 
 type commit struct {
 	data       []string
+	index      []uint64 // raft log index of each entry in data
 	applyDoneC chan<- struct{}
 }
 
@@ -52,67 +62,237 @@ type raftNode struct {
 	id          int      // client ID for raft session
 	peers       []string // raft peer URLs
 	join        bool     // node is joining an existing cluster
-	waldir      string   // path to WAL directory
-	snapdir     string   // path to snapshot directory
+	listenAddr  string   // address rafthttp listens on
+	tlsInfo     transport.TLSInfo
+	storage     string // StorageWAL or StorageBolt
+	waldir      string // path to WAL directory
+	boltPath    string // path to the bolt raft log
+	snapdir     string // path to snapshot directory
 	getSnapshot func() ([]byte, error)
 
 	confState     raftpb.ConfState
-	snapshotIndex uint64
+	membersMu     sync.RWMutex        // guards confState and peerURLs for readers outside the raft loop
+	peerURLs      map[uint64][]string // raft peer URLs by member ID
+	snapshotIndex uint64              // accessed atomically outside the raft loop
 	appliedIndex  uint64
 
 	// raft backing for the commit/error channel
 	node        raft.Node
-	raftStorage *raft.MemoryStorage
-	wal         *wal.WAL
+	raftStorage logStorage
+	wal         *wal.WAL // nil with the bolt storage
+	boltDB      *bolt.DB // nil with the WAL storage
 
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
-	snapCount uint64
-	transport *rafthttp.Transport
-	stopc     chan struct{} // signals proposal channel closed
-	httpstopc chan struct{} // signals http server to shutdown
-	httpdonec chan struct{} // signals http server shutdown complete
+	reqIDGen *idutil.Generator // IDs of read index requests and conf changes
+	confWait wait.Wait         // conf changes waiting to be applied
+
+	// linearizable reads
+	readWait           wait.Wait     // read index requests waiting for their ReadState
+	appliedWait        wait.WaitTime // triggered with appliedIndex once entries are published
+	publishedDataIndex uint64        // index of the last entry handed to commitC, accessed atomically
+	replayIndex        uint64        // commit index read from the WAL or bolt log on startup
+
+	lead uint64 // raft ID of the current leader, accessed atomically
+
+	snapCount     uint64
+	tickInterval  time.Duration
+	electionTick  int
+	heartbeatTick int
+	transport     *rafthttp.Transport
+	serverStats   *stats.ServerStats
+	leaderStats   *stats.LeaderStats
+	stopc         chan struct{} // signals proposal channel closed or Stop called
+	stopOnce      sync.Once     // guards closing stopc
+	donec         chan struct{} // signals the raft loop exited and the log is closed
+	httpstopc     chan struct{} // signals http server to shutdown
+	httpdonec     chan struct{} // signals http server shutdown complete
 
 	logger *zap.Logger
 }
 
 var defaultSnapshotCount uint64 = 10000
 
+// Storage backends of the raft log and hard state.
+const (
+	// StorageWAL appends to a WAL that is replayed into memory on startup.
+	StorageWAL = "wal"
+	// StorageBolt keeps the log in a BoltStorage, read in place on startup.
+	StorageBolt = "bolt"
+)
+
+// logStorage is the raft.Storage the raft loop writes to.
+type logStorage interface {
+	raft.Storage
+	SetHardState(st raftpb.HardState) error
+	ApplySnapshot(snap raftpb.Snapshot) error
+	CreateSnapshot(i uint64, cs *raftpb.ConfState, data []byte) (raftpb.Snapshot, error)
+	Compact(compactIndex uint64) error
+	Append(entries []raftpb.Entry) error
+}
+
+const (
+	defaultTickInterval  = 100 * time.Millisecond
+	defaultElectionTick  = 10
+	defaultHeartbeatTick = 1
+)
+
+// Config configures a raft node started by NewRaftNodeFromConfig. Zero
+// values fall back to the defaults used by NewRaftNode.
+type Config struct {
+	ID    int      // raft ID of this node, 1-based index into Peers
+	Peers []string // raft peer URLs of the initial cluster
+	Join  bool     // join an existing cluster instead of bootstrapping one
+
+	// ListenAddr is the address rafthttp listens on, by default the
+	// host of this node's peer URL.
+	ListenAddr string
+	WALDir     string
+	SnapDir    string
+
+	// Storage is StorageWAL, the default, or StorageBolt to keep the raft
+	// log in the bolt database at BoltPath instead of WALDir. Snapshots
+	// are written to SnapDir either way.
+	Storage  string
+	BoltPath string
+
+	// TLSInfo enables mutual TLS between peers when set. Certificates
+	// are read again on every handshake, so rotated files are picked up
+	// without a restart.
+	TLSInfo transport.TLSInfo
+
+	SnapshotCount uint64        // applied entries between two snapshots
+	TickInterval  time.Duration // duration of a raft logical clock tick
+	ElectionTick  int           // ticks without leader contact before an election
+	HeartbeatTick int           // ticks between leader heartbeats
+}
+
+// readIndexRetryTime is how often a read index request is resent while
+// no ReadState has been returned for it, e.g. during a leader election.
+var readIndexRetryTime = 500 * time.Millisecond
+
+// Node is a handle on a running raft node for the parts of its state
+// that are not carried by the propose and commit channels.
+type Node interface {
+	// ReadIndex asks the leader for its commit index and waits until every
+	// entry up to it has been published on the commit channel. It returns
+	// the index of the last entry published on the commit channel; once the
+	// state machine has applied that index it can serve linearizable reads.
+	ReadIndex(ctx context.Context) (uint64, error)
+	// ID returns the raft ID of this node.
+	ID() uint64
+	// Leader returns the raft ID of the current leader, or raft.None if
+	// no leader is known.
+	Leader() uint64
+
+	// Members returns the voters and learners of the cluster.
+	Members() []Member
+	// AddMember adds a voter or learner and waits until the change is applied.
+	AddMember(ctx context.Context, m Member) error
+	// RemoveMember removes a member and waits until the change is applied.
+	RemoveMember(ctx context.Context, id uint64) error
+	// PromoteMember turns a learner into a voter and waits until the
+	// change is applied.
+	PromoteMember(ctx context.Context, id uint64) error
+
+	// Status returns the raft state of this node.
+	Status() Status
+
+	// TransferLeadership hands leadership over to the most up-to-date
+	// voter and waits until it has taken over. It does nothing if this
+	// node is not the leader or has no other voter.
+	TransferLeadership(ctx context.Context) error
+	// Stop stops the raft node and waits until its log is closed. The
+	// commit and error channels are closed once it returns.
+	Stop()
+}
+
 // newRaftNode initiates a raft instance and returns a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
 // commit channel, followed by a nil message (to indicate the channel is
 // current), then new log entries. To shutdown, close proposeC and read errorC.
+// The returned Node may be used once the snapshotter is ready.
 func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan string,
-	confChangeC <-chan raftpb.ConfChange) (<-chan *commit, <-chan error, <-chan *snap.Snapshotter) {
+	confChangeC <-chan raftpb.ConfChange) (<-chan *commit, <-chan error, <-chan *snap.Snapshotter, Node) {
+	cfg := Config{ID: id, Peers: peers, Join: join}
+	return NewRaftNodeFromConfig(cfg, getSnapshot, proposeC, confChangeC)
+}
+
+// NewRaftNodeFromConfig is NewRaftNode with the data directories, listen
+// address and raft timings taken from cfg.
+func NewRaftNodeFromConfig(cfg Config, getSnapshot func() ([]byte, error), proposeC <-chan string,
+	confChangeC <-chan raftpb.ConfChange) (<-chan *commit, <-chan error, <-chan *snap.Snapshotter, Node) {
 
 	commitC := make(chan *commit)
 	errorC := make(chan error)
 
+	id := cfg.ID
+	if cfg.WALDir == "" {
+		cfg.WALDir = fmt.Sprintf("raftexample-%d", id)
+	}
+	if cfg.SnapDir == "" {
+		cfg.SnapDir = fmt.Sprintf("raftexample-%d-snap", id)
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = StorageWAL
+	}
+	if cfg.BoltPath == "" {
+		cfg.BoltPath = fmt.Sprintf("raftexample-%d.db", id)
+	}
+	if cfg.SnapshotCount == 0 {
+		cfg.SnapshotCount = defaultSnapshotCount
+	}
+	if cfg.TickInterval == 0 {
+		cfg.TickInterval = defaultTickInterval
+	}
+	if cfg.ElectionTick == 0 {
+		cfg.ElectionTick = defaultElectionTick
+	}
+	if cfg.HeartbeatTick == 0 {
+		cfg.HeartbeatTick = defaultHeartbeatTick
+	}
+
 	rc := &raftNode{
-		proposeC:    proposeC,
-		confChangeC: confChangeC,
-		commitC:     commitC,
-		errorC:      errorC,
-		id:          id,
-		peers:       peers,
-		join:        join,
-		waldir:      fmt.Sprintf("raftexample-%d", id),
-		snapdir:     fmt.Sprintf("raftexample-%d-snap", id),
-		getSnapshot: getSnapshot,
-		snapCount:   defaultSnapshotCount,
-		stopc:       make(chan struct{}),
-		httpstopc:   make(chan struct{}),
-		httpdonec:   make(chan struct{}),
+		proposeC:      proposeC,
+		confChangeC:   confChangeC,
+		commitC:       commitC,
+		errorC:        errorC,
+		id:            id,
+		peers:         cfg.Peers,
+		join:          cfg.Join,
+		listenAddr:    cfg.ListenAddr,
+		tlsInfo:       cfg.TLSInfo,
+		storage:       cfg.Storage,
+		waldir:        cfg.WALDir,
+		boltPath:      cfg.BoltPath,
+		snapdir:       cfg.SnapDir,
+		getSnapshot:   getSnapshot,
+		snapCount:     cfg.SnapshotCount,
+		tickInterval:  cfg.TickInterval,
+		electionTick:  cfg.ElectionTick,
+		heartbeatTick: cfg.HeartbeatTick,
+		peerURLs:      make(map[uint64][]string),
+		reqIDGen:      idutil.NewGenerator(uint16(id), time.Now()),
+		confWait:      wait.New(),
+		readWait:      wait.New(),
+		appliedWait:   wait.NewTimeList(),
+		stopc:         make(chan struct{}),
+		donec:         make(chan struct{}),
+		httpstopc:     make(chan struct{}),
+		httpdonec:     make(chan struct{}),
 
 		logger: zap.NewExample(),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
-		// rest of structure populated after WAL replay
+		// rest of structure populated after the log is opened
+	}
+	for i := range cfg.Peers {
+		rc.peerURLs[uint64(i+1)] = []string{cfg.Peers[i]}
 	}
 	go rc.startRaft()
-	return commitC, errorC, rc.snapshotterReady
+	return commitC, errorC, rc.snapshotterReady, rc
 }
 
 func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
@@ -127,6 +307,10 @@ func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
 	if err := rc.snapshotter.SaveSnap(snap); err != nil {
 		return err
 	}
+	if rc.wal == nil {
+		// the bolt log keeps the snapshot metadata with its entries
+		return nil
+	}
 	if err := rc.wal.SaveSnapshot(walSnap); err != nil {
 		return err
 	}
@@ -155,6 +339,7 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 	}
 
 	data := make([]string, 0, len(ents))
+	index := make([]uint64, 0, len(ents))
 	for i := range ents {
 		switch ents[i].Type {
 		case raftpb.EntryNormal:
@@ -164,22 +349,29 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 			}
 			s := string(ents[i].Data)
 			data = append(data, s)
+			index = append(index, ents[i].Index)
 		case raftpb.EntryConfChange:
 			var cc raftpb.ConfChange
 			cc.Unmarshal(ents[i].Data)
-			rc.confState = *rc.node.ApplyConfChange(cc)
+			rc.setConfState(*rc.node.ApplyConfChange(cc))
 			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
-				if len(cc.Context) > 0 {
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
+			case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+				if urls := peerURLsFromContext(cc.Context); len(urls) > 0 {
+					rc.setPeerURLs(cc.NodeID, urls)
+					if cc.NodeID != uint64(rc.id) {
+						rc.transport.AddPeer(types.ID(cc.NodeID), urls)
+					}
 				}
 			case raftpb.ConfChangeRemoveNode:
+				rc.setPeerURLs(cc.NodeID, nil)
 				if cc.NodeID == uint64(rc.id) {
 					log.Println("I've been removed from the cluster! Shutting down.")
+					rc.confWait.Trigger(cc.ID, nil)
 					return nil, false
 				}
 				rc.transport.RemovePeer(types.ID(cc.NodeID))
 			}
+			rc.confWait.Trigger(cc.ID, nil)
 		}
 	}
 
@@ -188,14 +380,16 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool)
 	if len(data) > 0 {
 		applyDoneC = make(chan struct{}, 1)
 		select {
-		case rc.commitC <- &commit{data, applyDoneC}:
+		case rc.commitC <- &commit{data, index, applyDoneC}:
 		case <-rc.stopc:
 			return nil, false
 		}
+		atomic.StoreUint64(&rc.publishedDataIndex, index[len(index)-1])
 	}
 
 	// after commit, update appliedIndex
 	rc.appliedIndex = ents[len(ents)-1].Index
+	rc.appliedWait.Trigger(rc.appliedIndex)
 
 	return applyDoneC, true
 }
@@ -251,18 +445,76 @@ func (rc *raftNode) replayWAL() *wal.WAL {
 	if err != nil {
 		log.Fatalf("raftexample: failed to read WAL (%v)", err)
 	}
-	rc.raftStorage = raft.NewMemoryStorage()
+	ms := raft.NewMemoryStorage()
 	if snapshot != nil {
-		rc.raftStorage.ApplySnapshot(*snapshot)
+		ms.ApplySnapshot(*snapshot)
 	}
-	rc.raftStorage.SetHardState(st)
+	ms.SetHardState(st)
+	rc.replayIndex = st.Commit
 
 	// append to storage so raft starts at the right place in log
-	rc.raftStorage.Append(ents)
+	ms.Append(ents)
+	rc.raftStorage = ms
 
 	return w
 }
 
+// openBolt opens the bolt raft log and reports whether it holds the state
+// of a previous run. Unlike the WAL nothing is read into memory: raft reads
+// the log from bolt and republishes the committed entries past the last
+// snapshot.
+func (rc *raftNode) openBolt() bool {
+	log.Printf("opening bolt raft log %s of member %d", rc.boltPath, rc.id)
+	db, err := bolt.Open(rc.boltPath, 0600, nil)
+	if err != nil {
+		log.Fatalf("raftexample: error opening bolt raft log (%v)", err)
+	}
+	bs, err := NewBoltStorage(db)
+	if err != nil {
+		log.Fatalf("raftexample: error initializing bolt raft log (%v)", err)
+	}
+	st, _, err := bs.InitialState()
+	if err != nil {
+		log.Fatalf("raftexample: error reading bolt raft log (%v)", err)
+	}
+	last, err := bs.LastIndex()
+	if err != nil {
+		log.Fatalf("raftexample: error reading bolt raft log (%v)", err)
+	}
+	rc.boltDB = db
+	rc.raftStorage = bs
+	rc.replayIndex = st.Commit
+	return !raft.IsEmptyHardState(st) || last > 0
+}
+
+// appendEntries adds the entries of a Ready to the raft storage once its
+// snapshot is applied. The WAL already saved them with the hard state; the
+// bolt log saves the hard state after the entries, so that it never
+// commits entries the log lacks.
+func (rc *raftNode) appendEntries(rd raft.Ready) {
+	if rc.wal != nil {
+		rc.raftStorage.Append(rd.Entries)
+		return
+	}
+	if err := rc.raftStorage.Append(rd.Entries); err != nil {
+		log.Fatalf("raftexample: error appending to bolt raft log (%v)", err)
+	}
+	if !raft.IsEmptyHardState(rd.HardState) {
+		if err := rc.raftStorage.SetHardState(rd.HardState); err != nil {
+			log.Fatalf("raftexample: error saving hard state to bolt raft log (%v)", err)
+		}
+	}
+}
+
+// closeLog closes the WAL or the bolt raft log.
+func (rc *raftNode) closeLog() {
+	if rc.wal != nil {
+		rc.wal.Close()
+		return
+	}
+	rc.boltDB.Close()
+}
+
 func (rc *raftNode) writeError(err error) {
 	rc.stopHTTP()
 	close(rc.commitC)
@@ -279,11 +531,16 @@ func (rc *raftNode) startRaft() {
 	}
 	rc.snapshotter = snap.New(zap.NewExample(), rc.snapdir)
 
-	oldwal := wal.Exist(rc.waldir)
-	rc.wal = rc.replayWAL()
-
-	// signal replay has finished
-	rc.snapshotterReady <- rc.snapshotter
+	var oldlog bool
+	switch rc.storage {
+	case StorageWAL:
+		oldlog = wal.Exist(rc.waldir)
+		rc.wal = rc.replayWAL()
+	case StorageBolt:
+		oldlog = rc.openBolt()
+	default:
+		log.Fatalf("raftexample: unknown raft storage %q", rc.storage)
+	}
 
 	rpeers := make([]raft.Peer, len(rc.peers))
 	for i := range rpeers {
@@ -291,27 +548,33 @@ func (rc *raftNode) startRaft() {
 	}
 	c := &raft.Config{
 		ID:                        uint64(rc.id),
-		ElectionTick:              10,
-		HeartbeatTick:             1,
+		ElectionTick:              rc.electionTick,
+		HeartbeatTick:             rc.heartbeatTick,
 		Storage:                   rc.raftStorage,
 		MaxSizePerMsg:             1024 * 1024,
 		MaxInflightMsgs:           256,
 		MaxUncommittedEntriesSize: 1 << 30,
+		// a leader cut off from the quorum steps down, so that it stops
+		// reporting ready
+		CheckQuorum: true,
 	}
 
-	if oldwal || rc.join {
+	if oldlog || rc.join {
 		rc.node = raft.RestartNode(c)
 	} else {
 		rc.node = raft.StartNode(c, rpeers)
 	}
 
+	rc.serverStats = stats.NewServerStats(strconv.Itoa(rc.id), strconv.Itoa(rc.id))
+	rc.leaderStats = stats.NewLeaderStats(zap.NewExample(), strconv.Itoa(rc.id))
 	rc.transport = &rafthttp.Transport{
 		Logger:      rc.logger,
 		ID:          types.ID(rc.id),
 		ClusterID:   0x1000,
 		Raft:        rc,
-		ServerStats: stats.NewServerStats("", ""),
-		LeaderStats: stats.NewLeaderStats(zap.NewExample(), strconv.Itoa(rc.id)),
+		TLSInfo:     rc.tlsInfo,
+		ServerStats: rc.serverStats,
+		LeaderStats: rc.leaderStats,
 		ErrorC:      make(chan error),
 	}
 
@@ -322,6 +585,9 @@ func (rc *raftNode) startRaft() {
 		}
 	}
 
+	// signal replay has finished
+	rc.snapshotterReady <- rc.snapshotter
+
 	go rc.serveRaft()
 	go rc.serveChannels()
 }
@@ -353,9 +619,11 @@ func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 	}
 	rc.commitC <- nil // trigger kvstore to load snapshot
 
-	rc.confState = snapshotToSave.Metadata.ConfState
-	rc.snapshotIndex = snapshotToSave.Metadata.Index
+	rc.setConfState(snapshotToSave.Metadata.ConfState)
+	atomic.StoreUint64(&rc.snapshotIndex, snapshotToSave.Metadata.Index)
 	rc.appliedIndex = snapshotToSave.Metadata.Index
+	atomic.StoreUint64(&rc.publishedDataIndex, rc.appliedIndex)
+	rc.appliedWait.Trigger(rc.appliedIndex)
 }
 
 var snapshotCatchUpEntriesN uint64 = 10000
@@ -386,17 +654,22 @@ func (rc *raftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	if err := rc.saveSnap(snap); err != nil {
 		panic(err)
 	}
+	snapshots.WithLabelValues("local").Inc()
 
 	compactIndex := uint64(1)
 	if rc.appliedIndex > snapshotCatchUpEntriesN {
 		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
 	}
 	if err := rc.raftStorage.Compact(compactIndex); err != nil {
-		panic(err)
+		// with a small snapshot count the catch-up window may not have
+		// moved since the last snapshot
+		if err != raft.ErrCompacted {
+			panic(err)
+		}
 	}
 
 	log.Printf("compacted log at index %d", compactIndex)
-	rc.snapshotIndex = rc.appliedIndex
+	atomic.StoreUint64(&rc.snapshotIndex, rc.appliedIndex)
 }
 
 func (rc *raftNode) serveChannels() {
@@ -404,13 +677,16 @@ func (rc *raftNode) serveChannels() {
 	if err != nil {
 		panic(err)
 	}
-	rc.confState = snap.Metadata.ConfState
-	rc.snapshotIndex = snap.Metadata.Index
+	rc.setConfState(snap.Metadata.ConfState)
+	atomic.StoreUint64(&rc.snapshotIndex, snap.Metadata.Index)
 	rc.appliedIndex = snap.Metadata.Index
+	atomic.StoreUint64(&rc.publishedDataIndex, rc.appliedIndex)
+	rc.appliedWait.Trigger(rc.appliedIndex)
 
-	defer rc.wal.Close()
+	defer close(rc.donec)
+	defer rc.closeLog()
 
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := time.NewTicker(rc.tickInterval)
 	defer ticker.Stop()
 
 	// send proposals over raft
@@ -435,10 +711,13 @@ func (rc *raftNode) serveChannels() {
 					cc.ID = confChangeCount
 					rc.node.ProposeConfChange(context.TODO(), cc)
 				}
+
+			case <-rc.stopc:
+				return
 			}
 		}
 		// client closed channel; shutdown raft if not already
-		close(rc.stopc)
+		rc.closeStop()
 	}()
 
 	// event loop on raft state machine updates
@@ -447,16 +726,38 @@ func (rc *raftNode) serveChannels() {
 		case <-ticker.C:
 			rc.node.Tick()
 
-		// store raft entries to wal, then publish over commit channel
+		// store raft entries to the log, then publish over commit channel
 		case rd := <-rc.node.Ready():
-			rc.wal.Save(rd.HardState, rd.Entries)
+			if rd.SoftState != nil {
+				prev := atomic.SwapUint64(&rc.lead, rd.SoftState.Lead)
+				if prev != rd.SoftState.Lead && rd.SoftState.Lead != raft.None {
+					leaderChanges.Inc()
+				}
+				if rd.SoftState.Lead == uint64(rc.id) {
+					if prev != rd.SoftState.Lead {
+						rc.serverStats.BecomeLeader()
+					}
+					isLeader.Set(1)
+				} else {
+					isLeader.Set(0)
+				}
+			}
+			if rc.wal != nil {
+				rc.wal.Save(rd.HardState, rd.Entries)
+			}
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				rc.saveSnap(rd.Snapshot)
 				rc.raftStorage.ApplySnapshot(rd.Snapshot)
 				rc.publishSnapshot(rd.Snapshot)
+				snapshots.WithLabelValues("leader").Inc()
 			}
-			rc.raftStorage.Append(rd.Entries)
+			rc.appendEntries(rd)
 			rc.transport.Send(rd.Messages)
+			for _, rs := range rd.ReadStates {
+				if len(rs.RequestCtx) == 8 {
+					rc.readWait.Trigger(binary.BigEndian.Uint64(rs.RequestCtx), rs.Index)
+				}
+			}
 			applyDoneC, ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries))
 			if !ok {
 				rc.stop()
@@ -477,17 +778,29 @@ func (rc *raftNode) serveChannels() {
 }
 
 func (rc *raftNode) serveRaft() {
-	url, err := url.Parse(rc.peers[rc.id-1])
-	if err != nil {
-		log.Fatalf("raftexample: Failed parsing URL (%v)", err)
+	addr := rc.listenAddr
+	if addr == "" {
+		url, err := url.Parse(rc.peers[rc.id-1])
+		if err != nil {
+			log.Fatalf("raftexample: Failed parsing URL (%v)", err)
+		}
+		addr = url.Host
 	}
 
-	ln, err := newStoppableListener(url.Host, rc.httpstopc)
+	ln, err := newStoppableListener(addr, rc.httpstopc)
 	if err != nil {
 		log.Fatalf("raftexample: Failed to listen rafthttp (%v)", err)
 	}
+	var l net.Listener = ln
+	if !rc.tlsInfo.Empty() {
+		tlsConfig, err := rc.tlsInfo.ServerConfig()
+		if err != nil {
+			log.Fatalf("raftexample: Failed to load peer TLS config (%v)", err)
+		}
+		l = tls.NewListener(ln, tlsConfig)
+	}
 
-	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
+	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(l)
 	select {
 	case <-rc.httpstopc:
 	default:
@@ -496,6 +809,90 @@ func (rc *raftNode) serveRaft() {
 	close(rc.httpdonec)
 }
 
+func (rc *raftNode) ReadIndex(ctx context.Context) (uint64, error) {
+	reqID := rc.reqIDGen.Next()
+	rctx := make([]byte, 8)
+	binary.BigEndian.PutUint64(rctx, reqID)
+	ch := rc.readWait.Register(reqID)
+
+	var readIndex uint64
+	for readIndex == 0 {
+		if err := rc.node.ReadIndex(ctx, rctx); err != nil {
+			rc.readWait.Trigger(reqID, nil) // GC wait
+			return 0, err
+		}
+		select {
+		case x := <-ch:
+			readIndex = x.(uint64)
+		case <-time.After(readIndexRetryTime):
+			// the request was dropped or is slow, ask again
+		case <-ctx.Done():
+			rc.readWait.Trigger(reqID, nil) // GC wait
+			return 0, ctx.Err()
+		case <-rc.stopc:
+			return 0, raft.ErrStopped
+		}
+	}
+
+	select {
+	case <-rc.appliedWait.Wait(readIndex):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-rc.stopc:
+		return 0, raft.ErrStopped
+	}
+	return atomic.LoadUint64(&rc.publishedDataIndex), nil
+}
+
+func (rc *raftNode) TransferLeadership(ctx context.Context) error {
+	st := rc.node.Status()
+	if st.RaftState != raft.StateLeader {
+		return nil
+	}
+	var transferee, match uint64
+	for id, pr := range st.Progress {
+		if id == st.ID || pr.IsLearner || !pr.RecentActive {
+			continue
+		}
+		if transferee == raft.None || pr.Match > match {
+			transferee, match = id, pr.Match
+		}
+	}
+	if transferee == raft.None {
+		return nil
+	}
+
+	log.Printf("transferring leadership from %d to %d", st.ID, transferee)
+	// raft aborts a transfer that takes longer than an election timeout
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rc.electionTick)*rc.tickInterval)
+	defer cancel()
+	rc.node.TransferLeadership(ctx, st.ID, transferee)
+	ticker := time.NewTicker(rc.tickInterval)
+	defer ticker.Stop()
+	for rc.Leader() != transferee {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.stopc:
+			return raft.ErrStopped
+		}
+	}
+	return nil
+}
+
+func (rc *raftNode) Stop() {
+	rc.closeStop()
+	<-rc.donec
+}
+
+func (rc *raftNode) closeStop() {
+	rc.stopOnce.Do(func() { close(rc.stopc) })
+}
+
+func (rc *raftNode) ID() uint64     { return uint64(rc.id) }
+func (rc *raftNode) Leader() uint64 { return atomic.LoadUint64(&rc.lead) }
+
 func (rc *raftNode) Process(ctx context.Context, m raftpb.Message) error {
 	return rc.node.Step(ctx, m)
 }
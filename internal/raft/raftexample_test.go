@@ -16,11 +16,13 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,6 +39,7 @@ func getSnapshotFn() (func() ([]byte, error), <-chan struct{}) {
 
 type cluster struct {
 	peers              []string
+	storage            string
 	commitC            []<-chan *commit
 	errorC             []<-chan error
 	proposeC           []chan string
@@ -46,6 +49,12 @@ type cluster struct {
 
 // newCluster creates a cluster of n nodes
 func newCluster(n int) *cluster {
+	return newStorageCluster(n, StorageWAL)
+}
+
+// newStorageCluster creates a cluster of n nodes keeping their raft log in
+// storage.
+func newStorageCluster(n int, storage string) *cluster {
 	peers := make([]string, n)
 	for i := range peers {
 		peers[i] = fmt.Sprintf("http://127.0.0.1:%d", 10000+i)
@@ -53,6 +62,7 @@ func newCluster(n int) *cluster {
 
 	clus := &cluster{
 		peers:              peers,
+		storage:            storage,
 		commitC:            make([]<-chan *commit, len(peers)),
 		errorC:             make([]<-chan error, len(peers)),
 		proposeC:           make([]chan string, len(peers)),
@@ -61,38 +71,96 @@ func newCluster(n int) *cluster {
 	}
 
 	for i := range clus.peers {
-		os.RemoveAll(fmt.Sprintf("raftexample-%d", i+1))
-		os.RemoveAll(fmt.Sprintf("raftexample-%d-snap", i+1))
-		clus.proposeC[i] = make(chan string, 1)
-		clus.confChangeC[i] = make(chan raftpb.ConfChange, 1)
-		fn, snapshotTriggeredC := getSnapshotFn()
-		clus.snapshotTriggeredC[i] = snapshotTriggeredC
-		clus.commitC[i], clus.errorC[i], _ = NewRaftNode(i+1, clus.peers, false, fn, clus.proposeC[i], clus.confChangeC[i])
+		removeData(i + 1)
+		clus.startNode(i)
 	}
 
 	return clus
 }
 
+// removeData removes the WAL, snapshots and bolt raft log of node id.
+func removeData(id int) {
+	os.RemoveAll(fmt.Sprintf("raftexample-%d", id))
+	os.RemoveAll(fmt.Sprintf("raftexample-%d-snap", id))
+	os.RemoveAll(fmt.Sprintf("raftexample-%d.db", id))
+}
+
+// startNode starts node i of the cluster, restarting it from its raft log
+// if it ran before.
+func (clus *cluster) startNode(i int) {
+	clus.proposeC[i] = make(chan string, 1)
+	clus.confChangeC[i] = make(chan raftpb.ConfChange, 1)
+	fn, snapshotTriggeredC := getSnapshotFn()
+	clus.snapshotTriggeredC[i] = snapshotTriggeredC
+	cfg := Config{ID: i + 1, Peers: clus.peers, Storage: clus.storage}
+	clus.commitC[i], clus.errorC[i], _, _ = NewRaftNodeFromConfig(cfg, fn, clus.proposeC[i], clus.confChangeC[i])
+}
+
+// stopNode stops node i of the cluster, keeping its raft log.
+func (clus *cluster) stopNode(i int) error {
+	go func(commitC <-chan *commit) {
+		for range commitC {
+			// drain pending commits
+		}
+	}(clus.commitC[i])
+	close(clus.proposeC[i])
+	// wait for channel to close
+	return <-clus.errorC[i]
+}
+
 // Close closes all cluster nodes and returns an error if any failed.
 func (clus *cluster) Close() (err error) {
 	for i := range clus.peers {
-		go func(i int) {
-			for range clus.commitC[i] {
-				// drain pending commits
-			}
-		}(i)
-		close(clus.proposeC[i])
-		// wait for channel to close
-		if erri := <-clus.errorC[i]; erri != nil {
+		if erri := clus.stopNode(i); erri != nil {
 			err = erri
 		}
 		// clean intermediates
-		os.RemoveAll(fmt.Sprintf("raftexample-%d", i+1))
-		os.RemoveAll(fmt.Sprintf("raftexample-%d-snap", i+1))
+		removeData(i + 1)
 	}
 	return err
 }
 
+// waitData reads the commits of nodes until each published n entries,
+// returning the entries of each node. The nodes are read concurrently, as
+// a leader blocked on its commit channel stalls the cluster.
+func (clus *cluster) waitData(t *testing.T, n int, nodes ...int) [][]string {
+	t.Helper()
+	data := make([][]string, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for j, i := range nodes {
+		wg.Add(1)
+		go func(j, i int) {
+			defer wg.Done()
+			timeout := time.After(10 * time.Second)
+			for len(data[j]) < n {
+				select {
+				case c, ok := <-clus.commitC[i]:
+					if !ok {
+						errs[j] = fmt.Errorf("node %d stopped after committing %q", i+1, data[j])
+						return
+					}
+					if c == nil {
+						continue
+					}
+					data[j] = append(data[j], c.data...)
+					close(c.applyDoneC)
+				case <-timeout:
+					errs[j] = fmt.Errorf("node %d committed %q, want %d entries", i+1, data[j], n)
+					return
+				}
+			}
+		}(j, i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
 func (clus *cluster) closeNoErrors(t *testing.T) {
 	t.Log("closing cluster...")
 	if err := clus.Close(); err != nil {
@@ -175,9 +243,9 @@ func TestPutAndGetKeyValue(t *testing.T) {
 
 	var kvs *KVStore
 	getSnapshot := func() ([]byte, error) { return kvs.GetSnapshot() }
-	commitC, errorC, snapshotterReady := NewRaftNode(1, clusters, false, getSnapshot, proposeC, confChangeC)
+	commitC, errorC, snapshotterReady, _ := NewRaftNode(1, clusters, false, getSnapshot, proposeC, confChangeC)
 
-	kvs = NewKVStore(<-snapshotterReady, proposeC, commitC, errorC)
+	kvs = NewKVStore(1, <-snapshotterReady, proposeC, commitC, errorC)
 
 	srv := httptest.NewServer(&httpKVAPI{
 		store:       kvs,
@@ -285,3 +353,108 @@ func TestSnapshot(t *testing.T) {
 	close(c.applyDoneC)
 	<-clus.snapshotTriggeredC[0]
 }
+
+// TestBoltStorageRestart runs a cluster on the bolt raft storage and
+// restarts a node, which replays the entries committed before it stopped
+// from its bolt log and rejoins the cluster.
+func TestBoltStorageRestart(t *testing.T) {
+	clus := newStorageCluster(3, StorageBolt)
+	defer clus.closeNoErrors(t)
+
+	go func() {
+		clus.proposeC[0] <- "foo"
+		clus.proposeC[0] <- "bar"
+	}()
+	data := clus.waitData(t, 2, 0, 1, 2)
+	for i := range clus.peers {
+		if data[i][0] != "foo" || data[i][1] != "bar" {
+			t.Fatalf("node %d committed %q, want [foo bar]", i+1, data[i])
+		}
+	}
+	if _, err := os.Stat("raftexample-3"); !os.IsNotExist(err) {
+		t.Errorf("WAL directory created with the bolt storage: %v", err)
+	}
+
+	if err := clus.stopNode(2); err != nil {
+		t.Fatal(err)
+	}
+	clus.startNode(2)
+	data = clus.waitData(t, 2, 2)
+	if data[0][0] != "foo" || data[0][1] != "bar" {
+		t.Fatalf("restarted node replayed %q, want [foo bar]", data[0])
+	}
+
+	// the restarted node only proposes once it knows the leader
+	go func() { clus.proposeC[2] <- "baz" }()
+	data = clus.waitData(t, 1, 0, 1, 2)
+	for i := range clus.peers {
+		if data[i][0] != "baz" {
+			t.Fatalf("node %d committed %q, want [baz]", i+1, data[i])
+		}
+	}
+}
+
+// TestBoltStorageSnapshotRestart restarts a node whose bolt log has been
+// compacted: the store recovers from the snapshot and raft replays the
+// entries after it from bolt.
+func TestBoltStorageSnapshotRestart(t *testing.T) {
+	prevDefaultSnapshotCount := defaultSnapshotCount
+	prevSnapshotCatchUpEntriesN := snapshotCatchUpEntriesN
+	defaultSnapshotCount = 4
+	snapshotCatchUpEntriesN = 4
+	defer func() {
+		defaultSnapshotCount = prevDefaultSnapshotCount
+		snapshotCatchUpEntriesN = prevSnapshotCatchUpEntriesN
+	}()
+	removeData(1)
+	defer removeData(1)
+
+	start := func() (*KVStore, chan string, <-chan error) {
+		proposeC := make(chan string)
+		confChangeC := make(chan raftpb.ConfChange)
+		var kvs *KVStore
+		getSnapshot := func() ([]byte, error) { return kvs.GetSnapshot() }
+		cfg := Config{ID: 1, Peers: []string{"http://127.0.0.1:9022"}, Storage: StorageBolt}
+		commitC, errorC, snapshotterReady, _ := NewRaftNodeFromConfig(cfg, getSnapshot, proposeC, confChangeC)
+		kvs = NewKVStore(1, <-snapshotterReady, proposeC, commitC, errorC)
+		return kvs, proposeC, errorC
+	}
+	waitKeys := func(kvs *KVStore) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for i := 0; i < 10; i++ {
+			key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+			for {
+				if v, ok := kvs.Lookup(key); ok {
+					if v != want {
+						t.Errorf("%s = %q, want %q", key, v, want)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%s not applied", key)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	kvs, proposeC, errorC := start()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := kvs.Propose(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if snaps, err := os.ReadDir("raftexample-1-snap"); err != nil || len(snaps) == 0 {
+		t.Fatalf("no snapshot after 10 entries: %v", err)
+	}
+	close(proposeC)
+	<-errorC
+
+	kvs, proposeC, _ = start()
+	defer close(proposeC)
+	waitKeys(kvs)
+}
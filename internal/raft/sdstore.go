@@ -0,0 +1,548 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/momirjalili/httpsd/internal/api"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"go.etcd.io/etcd/pkg/v3/wait"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/snap"
+)
+
+// SDStore is a target store backed by raft. Reads are served from the
+// local bolt store; mutations are proposed as commands on the raft log and
+// applied to the bolt store of every node once committed.
+type SDStore struct {
+	proposeC    chan<- string // channel for proposing commands
+	tracker     *proposalTracker
+	node        Node
+	store       *httpsd.TargetStore
+	snapshotter *snap.Snapshotter
+	lessor      *lessor
+
+	appliedIndex uint64        // raft index of the last applied command, accessed atomically
+	appliedWait  wait.WaitTime // triggered with appliedIndex
+
+	donec chan struct{} // closed once the commit channel is drained
+
+	// MaxApplyLag is how many committed entries the store may be behind
+	// the commit index while the node reports ready.
+	MaxApplyLag uint64
+}
+
+// defaultMaxApplyLag is the MaxApplyLag of a new SDStore.
+var defaultMaxApplyLag uint64 = 100
+
+// applyResult is handed to the proposer of a command once it is applied.
+type applyResult struct {
+	cmd *httpsd.Command
+	err error
+}
+
+func NewSDStore(id int, snapshotter *snap.Snapshotter, node Node, store *httpsd.TargetStore, proposeC chan<- string, commitC <-chan *commit, errorC <-chan error) *SDStore {
+	s := &SDStore{
+		proposeC:    proposeC,
+		tracker:     newProposalTracker(id),
+		node:        node,
+		store:       store,
+		snapshotter: snapshotter,
+		lessor:      newLessor(),
+		appliedWait: wait.NewTimeList(),
+		donec:       make(chan struct{}),
+		MaxApplyLag: defaultMaxApplyLag,
+	}
+	snapshot, err := s.loadSnapshot()
+	if err != nil {
+		log.Panic(err)
+	}
+	if snapshot != nil {
+		applied, err := store.AppliedIndex()
+		if err != nil {
+			log.Panic(err)
+		}
+		// the bolt store is durable, only recover if it is behind the snapshot
+		if applied < snapshot.Metadata.Index {
+			log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+			if err := s.recoverFromSnapshot(snapshot); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+	applied, err := store.AppliedIndex()
+	if err != nil {
+		log.Panic(err)
+	}
+	s.setAppliedIndex(applied)
+	if err := s.resetLeases(); err != nil {
+		log.Panic(err)
+	}
+	// read commits from raft into the target store until error
+	go s.readCommits(commitC, errorC)
+	go s.expireLeases()
+	return s
+}
+
+// Revision returns the raft index of the last applied command.
+func (s *SDStore) Revision() uint64 {
+	return atomic.LoadUint64(&s.appliedIndex)
+}
+
+func (s *SDStore) GetAllTargetGroups() ([]httpsd.TargetGroup, error) {
+	return s.store.GetAllTargetGroups()
+}
+
+func (s *SDStore) GetTargetGroup(id uint64) (*httpsd.TargetGroup, error) {
+	return s.store.GetTargetGroup(id)
+}
+
+func (s *SDStore) FindByAddress(addr string) ([]httpsd.AddrMatch, error) {
+	return s.store.FindByAddress(addr)
+}
+
+// Publish registers apiURL as the API address of this node in the
+// replicated store, so that followers can forward writes to it whenever it
+// leads. It retries until the registration is applied or ctx is done.
+func (s *SDStore) Publish(ctx context.Context, apiURL string) {
+	m := &httpsd.Member{ID: s.node.ID(), APIURL: apiURL}
+	for {
+		if cur, ok := s.store.GetMember(m.ID); ok && *cur == *m {
+			return
+		}
+		_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpPublishMember, Member: m})
+		if err == nil {
+			log.Printf("published api url %s of member %d", apiURL, m.ID)
+			return
+		}
+		log.Printf("httpsd: publishing api url failed, retrying (%v)", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// IsLeader reports whether this node is the raft leader.
+func (s *SDStore) IsLeader() bool {
+	return s.node.Leader() == s.node.ID()
+}
+
+// LeaderURL returns the published API URL of the current leader, or ""
+// if there is no leader or it has not published its URL yet.
+func (s *SDStore) LeaderURL() string {
+	lead := s.node.Leader()
+	if lead == raft.None {
+		return ""
+	}
+	m, ok := s.store.GetMember(lead)
+	if !ok {
+		return ""
+	}
+	return m.APIURL
+}
+
+// Members lists the raft members along with the API URL each of them published.
+func (s *SDStore) Members() ([]api.Member, error) {
+	lead := s.node.Leader()
+	members := []api.Member{}
+	for _, rm := range s.node.Members() {
+		m := api.Member{ID: rm.ID, PeerURLs: rm.PeerURLs, IsLearner: rm.IsLearner, IsLeader: rm.ID == lead}
+		if pm, ok := s.store.GetMember(rm.ID); ok {
+			m.APIURL = pm.APIURL
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (s *SDStore) member(id uint64) (*api.Member, error) {
+	members, err := s.Members()
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		if members[i].ID == id {
+			return &members[i], nil
+		}
+	}
+	return nil, httpsd.ErrMemberNotFound
+}
+
+// AddMember adds a voter or learner. The new node publishes its API URL
+// itself once it has caught up with the cluster.
+func (s *SDStore) AddMember(ctx context.Context, m api.Member) (*api.Member, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.tracker.timeout)
+	defer cancel()
+	if err := s.node.AddMember(ctx, Member{ID: m.ID, PeerURLs: m.PeerURLs, IsLearner: m.IsLearner}); err != nil {
+		return nil, err
+	}
+	return s.member(m.ID)
+}
+
+// RemoveMember removes a member from raft and drops its published attributes.
+func (s *SDStore) RemoveMember(ctx context.Context, id uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.tracker.timeout)
+	defer cancel()
+	if err := s.node.RemoveMember(ctx, id); err != nil {
+		return err
+	}
+	if id == s.node.ID() {
+		// this node is shutting down, the others keep the stale attributes
+		return nil
+	}
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpRemoveMember, Member: &httpsd.Member{ID: id}})
+	return err
+}
+
+// PromoteMember turns a learner into a voter.
+func (s *SDStore) PromoteMember(ctx context.Context, id uint64) (*api.Member, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.tracker.timeout)
+	defer cancel()
+	if err := s.node.PromoteMember(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.member(id)
+}
+
+// Status reports the raft state of this node and how far the store is behind it.
+func (s *SDStore) Status() (*api.ClusterStatus, error) {
+	st := s.node.Status()
+	cs := &api.ClusterStatus{
+		ID:                st.ID,
+		Leader:            st.Lead,
+		RaftState:         st.RaftState.String(),
+		Term:              st.Term,
+		Vote:              st.Vote,
+		CommitIndex:       st.Commit,
+		AppliedIndex:      st.Applied,
+		StoreAppliedIndex: atomic.LoadUint64(&s.appliedIndex),
+		SnapshotIndex:     st.SnapshotIndex,
+		WALDir:            st.WALDir,
+		SnapDir:           st.SnapDir,
+		ServerStats:       st.ServerStats,
+		LeaderStats:       st.LeaderStats,
+	}
+	if len(st.Progress) > 0 {
+		cs.Progress = make(map[uint64]api.Progress, len(st.Progress))
+		for id, pr := range st.Progress {
+			cs.Progress[id] = api.Progress{
+				Match:        pr.Match,
+				Next:         pr.Next,
+				State:        pr.State.String(),
+				RecentActive: pr.RecentActive,
+				Paused:       pr.IsPaused(),
+				IsLearner:    pr.IsLearner,
+			}
+		}
+	}
+	return cs, nil
+}
+
+// Live returns an error if the bolt store cannot be read.
+func (s *SDStore) Live() error {
+	_, err := s.store.AppliedIndex()
+	return err
+}
+
+// Ready returns an error unless this node is a member of the cluster,
+// knows the leader, has replayed its WAL and applies committed entries
+// with at most MaxApplyLag entries of delay.
+func (s *SDStore) Ready() error {
+	return readyError(s.node.Status(), atomic.LoadUint64(&s.appliedIndex), s.MaxApplyLag)
+}
+
+// readyError is the reason a node of status st, whose store applied the
+// command at storeApplied, is not ready, or nil.
+func readyError(st Status, storeApplied, maxLag uint64) error {
+	if _, ok := st.Config.Voters.IDs()[st.ID]; !ok {
+		if _, ok := st.Config.Learners[st.ID]; !ok {
+			return fmt.Errorf("member %x has not joined the cluster", st.ID)
+		}
+	}
+	if st.Lead == raft.None {
+		return fmt.Errorf("no leader")
+	}
+	// the store skips empty entries and conf changes, once it has applied
+	// every command handed to it, it is as far as raft
+	applied := storeApplied
+	if applied >= st.PublishedIndex {
+		applied = st.Applied
+	}
+	if applied < st.ReplayIndex {
+		return fmt.Errorf("replaying WAL, applied index %d of %d", applied, st.ReplayIndex)
+	}
+	if lag := st.Commit - applied; st.Commit > applied && lag > maxLag {
+		return fmt.Errorf("applied index %d is %d entries behind commit index %d", applied, lag, st.Commit)
+	}
+	return nil
+}
+
+// LinearizableRead blocks until the local store has applied every command
+// committed before the call, so that reads following it are not stale.
+func (s *SDStore) LinearizableRead(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.tracker.timeout)
+	defer cancel()
+	index, err := s.node.ReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.appliedWait.Wait(index):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SDStore) CreateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpCreateTargetGroup, TargetGroup: tg, Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.TargetGroup, nil
+}
+
+func (s *SDStore) UpdateTargetGroup(ctx context.Context, tg *httpsd.TargetGroup, auth *httpsd.Token) (*httpsd.TargetGroup, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpUpdateTargetGroup, TargetGroup: tg, Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.TargetGroup, nil
+}
+
+func (s *SDStore) DeleteTargetGroup(ctx context.Context, id uint64, auth *httpsd.Token) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteTargetGroup, GroupID: id, Auth: auth})
+	return err
+}
+
+func (s *SDStore) DeleteTarget(ctx context.Context, tgID uint64, tID uint64, auth *httpsd.Token) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteTarget, GroupID: tgID, TargetID: tID, Auth: auth})
+	return err
+}
+
+func (s *SDStore) DeleteTargetAddr(ctx context.Context, tgID uint64, addr string, auth *httpsd.Token) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteTargetAddr, GroupID: tgID, Addr: addr, Auth: auth})
+	return err
+}
+
+func (s *SDStore) MoveTarget(ctx context.Context, fromID, toID uint64, addr string, auth *httpsd.Token) (uint64, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpMoveTarget, GroupID: fromID, ToGroupID: toID, Addr: addr, Auth: auth})
+	if err != nil {
+		return 0, err
+	}
+	return cmd.TargetID, nil
+}
+
+func (s *SDStore) RemoveAddr(ctx context.Context, addr string, groupIDs []uint64, auth *httpsd.Token) ([]uint64, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpRemoveAddr, Addr: addr, GroupIDs: groupIDs, Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.GroupIDs, nil
+}
+
+func (s *SDStore) DeleteLabel(ctx context.Context, tgID uint64, labelKey string, auth *httpsd.Token) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteLabel, GroupID: tgID, LabelKey: labelKey, Auth: auth})
+	return err
+}
+
+func (s *SDStore) GetTokenByHash(hash string) (*httpsd.Token, bool) {
+	return s.store.GetTokenByHash(hash)
+}
+
+func (s *SDStore) GetTokens() ([]httpsd.Token, error) {
+	return s.store.GetTokens()
+}
+
+func (s *SDStore) CreateToken(ctx context.Context, t *httpsd.Token) (*httpsd.Token, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpCreateToken, Token: t})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.Token, nil
+}
+
+func (s *SDStore) DeleteToken(ctx context.Context, id uint64) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteToken, TokenID: id})
+	return err
+}
+
+func (s *SDStore) GetJob(name string) (*httpsd.Job, error) {
+	return s.store.GetJob(name)
+}
+
+func (s *SDStore) GetJobs() ([]httpsd.Job, error) {
+	return s.store.GetJobs()
+}
+
+func (s *SDStore) PutJob(ctx context.Context, j *httpsd.Job) (*httpsd.Job, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpPutJob, Job: j})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.Job, nil
+}
+
+func (s *SDStore) DeleteJob(ctx context.Context, name string) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteJob, JobName: name})
+	return err
+}
+
+func (s *SDStore) GetLease(id uint64) (*httpsd.Lease, error) {
+	return s.store.GetLease(id)
+}
+
+func (s *SDStore) GetLeases() ([]httpsd.Lease, error) {
+	return s.store.GetLeases()
+}
+
+func (s *SDStore) GrantLease(ctx context.Context, ttl int64) (*httpsd.Lease, error) {
+	cmd, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpGrantLease, Lease: &httpsd.Lease{TTL: ttl}})
+	if err != nil {
+		return nil, err
+	}
+	return cmd.Lease, nil
+}
+
+func (s *SDStore) RevokeLease(ctx context.Context, id uint64, auth *httpsd.Token) error {
+	_, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpRevokeLease, LeaseID: id, Auth: auth})
+	return err
+}
+
+// KeepAlive renews a lease for its TTL. Only the leader's renewals count,
+// so it fails with api.ErrNotLeader on a follower.
+func (s *SDStore) KeepAlive(id uint64) (*httpsd.Lease, error) {
+	if !s.IsLeader() {
+		return nil, api.ErrNotLeader
+	}
+	if _, err := s.lessor.renew(id); err != nil {
+		return nil, err
+	}
+	return s.store.GetLease(id)
+}
+
+// resetLeases tracks the expiry of the leases in the store from now on.
+func (s *SDStore) resetLeases() error {
+	leases, err := s.store.GetLeases()
+	if err != nil {
+		return err
+	}
+	s.lessor.reset(leases)
+	return nil
+}
+
+// propose proposes cmd and waits until it is applied, returning the applied
+// command (with generated IDs filled in) or the error it failed with.
+func (s *SDStore) propose(ctx context.Context, cmd *httpsd.Command) (*httpsd.Command, error) {
+	x, err := s.tracker.propose(ctx, s.proposeC, func(reqID uint64) (string, error) {
+		cmd.RequestID = reqID
+		return httpsd.EncodeCommand(cmd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := x.(*applyResult)
+	return res.cmd, res.err
+}
+
+// Stop hands leadership over if this node leads, then stops the raft node
+// and waits until every committed command it published has been applied.
+// The target store is not used by raft anymore once Stop returns.
+func (s *SDStore) Stop(ctx context.Context) {
+	if err := s.node.TransferLeadership(ctx); err != nil {
+		log.Printf("httpsd: leadership transfer failed (%v)", err)
+	}
+	s.node.Stop()
+	<-s.donec
+}
+
+func (s *SDStore) readCommits(commitC <-chan *commit, errorC <-chan error) {
+	defer close(s.donec)
+	for commit := range commitC {
+		if commit == nil {
+			// signaled to load snapshot
+			snapshot, err := s.loadSnapshot()
+			if err != nil {
+				log.Panic(err)
+			}
+			if snapshot != nil {
+				log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+				if err := s.recoverFromSnapshot(snapshot); err != nil {
+					log.Panic(err)
+				}
+				if err := s.resetLeases(); err != nil {
+					log.Panic(err)
+				}
+			}
+			continue
+		}
+
+		for i, data := range commit.data {
+			cmd, err := httpsd.DecodeCommand(data)
+			if err != nil {
+				log.Fatalf("httpsd: could not decode command (%v)", err)
+			}
+			start := time.Now()
+			err = s.store.Apply(commit.index[i], cmd)
+			applyDuration.Observe(time.Since(start).Seconds())
+			if err != nil {
+				log.Printf("httpsd: %s at index %d failed (%v)", cmd.Op, commit.index[i], err)
+			} else if cmd.Op == httpsd.OpGrantLease {
+				// Apply skips commands replayed at or below the store's
+				// applied index, leaving the lease without an ID; only
+				// track leases the store really holds
+				if l, err := s.store.GetLease(cmd.Lease.ID); err == nil {
+					s.lessor.grant(l)
+				}
+			} else if cmd.Op == httpsd.OpRevokeLease {
+				s.lessor.revoke(cmd.LeaseID)
+			}
+			s.setAppliedIndex(commit.index[i])
+			s.tracker.trigger(cmd.RequestID, &applyResult{cmd: cmd, err: err})
+		}
+		close(commit.applyDoneC)
+	}
+	if err, ok := <-errorC; ok {
+		log.Fatal(err)
+	}
+}
+
+func (s *SDStore) GetSnapshot() ([]byte, error) {
+	return s.store.Snapshot()
+}
+
+func (s *SDStore) loadSnapshot() (*raftpb.Snapshot, error) {
+	snapshot, err := s.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *SDStore) recoverFromSnapshot(snapshot *raftpb.Snapshot) error {
+	if err := s.store.Restore(snapshot.Data, snapshot.Metadata.Index); err != nil {
+		return err
+	}
+	s.setAppliedIndex(snapshot.Metadata.Index)
+	return nil
+}
+
+// setAppliedIndex records index as applied and wakes up the linearizable
+// reads waiting for it. Entries replayed from the WAL may be older than
+// what the bolt store already holds, so the index never moves backwards.
+func (s *SDStore) setAppliedIndex(index uint64) {
+	if index <= atomic.LoadUint64(&s.appliedIndex) {
+		return
+	}
+	atomic.StoreUint64(&s.appliedIndex, index)
+	s.appliedWait.Trigger(index)
+}
@@ -0,0 +1,269 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/momirjalili/httpsd/internal/api"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/raft/v3"
+	"go.etcd.io/etcd/raft/v3/quorum"
+	pb "go.etcd.io/etcd/raft/v3/raftpb"
+	"go.etcd.io/etcd/raft/v3/tracker"
+)
+
+// sdNode is an SDStore on a raft node keeping its data in dir.
+type sdNode struct {
+	*SDStore
+	node  Node
+	store *httpsd.TargetStore
+}
+
+// startSDNode starts member id of the cluster of peers with its data in
+// dir, restarting it from the data of an earlier run.
+func startSDNode(t *testing.T, dir string, id int, peers []string, join bool) *sdNode {
+	t.Helper()
+	return startSDNodeConfig(t, dir, Config{ID: id, Peers: peers, Join: join})
+}
+
+// startSDNodeConfig starts the member of cfg with its data in dir.
+func startSDNodeConfig(t *testing.T, dir string, cfg Config) *sdNode {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(dir, "httpsd.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := httpsd.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposeC := make(chan string)
+	confChangeC := make(chan pb.ConfChange)
+	var sds *SDStore
+	getSnapshot := func() ([]byte, error) { return sds.GetSnapshot() }
+	cfg.WALDir, cfg.SnapDir = filepath.Join(dir, "wal"), filepath.Join(dir, "snap")
+	commitC, errorC, snapshotterReady, node := NewRaftNodeFromConfig(cfg, getSnapshot, proposeC, confChangeC)
+	sds = NewSDStore(cfg.ID, <-snapshotterReady, node, store, proposeC, commitC, errorC)
+	return &sdNode{SDStore: sds, node: node, store: store}
+}
+
+// startSDCluster starts a cluster of n SDStores whose raft peers listen
+// on the ports from port on, and stops it when the test ends.
+func startSDCluster(t *testing.T, n, port int) []*sdNode {
+	t.Helper()
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("http://127.0.0.1:%d", port+i)
+	}
+	nodes := make([]*sdNode, n)
+	for i := range nodes {
+		nodes[i] = startSDNode(t, t.TempDir(), i+1, peers, false)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.stop(t)
+		}
+	})
+	return nodes
+}
+
+// stop stops the raft node and closes the target store.
+func (n *sdNode) stop(t *testing.T) {
+	t.Helper()
+	n.Stop(context.Background())
+	if err := n.store.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// testContext returns a context for a test request, long enough to
+// elect a leader.
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+// readyStatus is the status of voter 1 of a cluster led by leader, that
+// committed commit and applied applied, having published the command at
+// published to the store.
+func readyStatus(leader, commit, applied, published uint64) Status {
+	var st Status
+	st.ID = 1
+	st.Lead = leader
+	st.HardState = pb.HardState{Commit: commit}
+	st.Applied = applied
+	st.Config = tracker.Config{Voters: quorum.JointConfig{quorum.MajorityConfig{1: {}, 2: {}, 3: {}}}}
+	st.PublishedIndex = published
+	return st
+}
+
+func TestReadyError(t *testing.T) {
+	learner := readyStatus(2, 10, 10, 10)
+	learner.Config = tracker.Config{Voters: quorum.JointConfig{quorum.MajorityConfig{2: {}}}, Learners: map[uint64]struct{}{1: {}}}
+	removed := readyStatus(2, 10, 10, 10)
+	removed.Config = tracker.Config{Voters: quorum.JointConfig{quorum.MajorityConfig{2: {}}}}
+	replaying := readyStatus(2, 500, 400, 400)
+	replaying.ReplayIndex = 450
+
+	tests := []struct {
+		name         string
+		st           Status
+		storeApplied uint64
+		maxLag       uint64
+		err          string // a part of the error, "" if ready
+	}{
+		{"in sync", readyStatus(2, 10, 10, 10), 10, 100, ""},
+		{"learner", learner, 10, 100, ""},
+		{"not a member", removed, 10, 100, "has not joined"},
+		{"no leader", readyStatus(raft.None, 10, 10, 10), 10, 100, "no leader"},
+		{"replaying", replaying, 400, 100, "replaying WAL"},
+		{"lag at the limit", readyStatus(2, 200, 100, 100), 100, 100, ""},
+		{"lag over the limit", readyStatus(2, 201, 100, 100), 100, 100, "101 entries behind"},
+		// raft applied conf changes and empty entries past the last command
+		{"store caught up", readyStatus(2, 300, 300, 150), 150, 100, ""},
+		// the store is still applying what raft handed it
+		{"store behind", readyStatus(2, 300, 300, 150), 120, 100, "180 entries behind"},
+		{"commit behind applied", readyStatus(2, 5, 10, 10), 10, 0, ""},
+	}
+	for _, tc := range tests {
+		err := readyError(tc.st, tc.storeApplied, tc.maxLag)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: readyError() = %v, want ready", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: readyError() = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+// TestLeaseReplay restarts a node that granted and revoked leases. Replayed
+// commands are skipped by the store, so the lessor must only track the
+// lease still held by it.
+func TestLeaseReplay(t *testing.T) {
+	dir := t.TempDir()
+	peers := []string{"http://127.0.0.1:9031"}
+	n := startSDNode(t, dir, 1, peers, false)
+	ctx, cancel := testContext()
+	defer cancel()
+	kept, err := n.GrantLease(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := n.GrantLease(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RevokeLease(ctx, revoked.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	n.stop(t)
+
+	n = startSDNode(t, dir, 1, peers, false)
+	defer n.stop(t)
+	// commands are applied in order, so the replayed ones are done once
+	// a new one is applied
+	if _, err := n.CreateTargetGroup(ctx, &httpsd.TargetGroup{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	n.lessor.mu.Lock()
+	defer n.lessor.mu.Unlock()
+	if len(n.lessor.ttl) != 1 || n.lessor.ttl[kept.ID] == 0 {
+		t.Errorf("leases tracked after a replay = %v, want only lease %d", n.lessor.ttl, kept.ID)
+	}
+}
+
+// TestLinearizableRead reads every write right after it on a member that
+// did not propose it.
+func TestLinearizableRead(t *testing.T) {
+	nodes := startSDCluster(t, 3, 9051)
+	ctx, cancel := testContext()
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		writer, reader := nodes[i%3], nodes[(i+1)%3]
+		tg, err := writer.CreateTargetGroup(ctx, &httpsd.TargetGroup{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reader.LinearizableRead(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.GetTargetGroup(tg.ID); err != nil {
+			t.Errorf("target group %d on node %d after a linearizable read: %v", tg.ID, reader.node.ID(), err)
+		}
+	}
+}
+
+// TestLinearizableReadTimeout reads on a member that cannot reach a quorum.
+func TestLinearizableReadTimeout(t *testing.T) {
+	peers := []string{"http://127.0.0.1:9061", "http://127.0.0.1:9062", "http://127.0.0.1:9063"}
+	n := startSDNode(t, t.TempDir(), 1, peers, false)
+	defer n.stop(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := n.LinearizableRead(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LinearizableRead without a quorum: err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestMembership adds a learner to a single node cluster, promotes it once
+// it has caught up and removes it again.
+func TestMembership(t *testing.T) {
+	peers := []string{"http://127.0.0.1:9071", "http://127.0.0.1:9072"}
+	n1 := startSDNode(t, t.TempDir(), 1, peers[:1], false)
+	defer n1.stop(t)
+	ctx, cancel := testContext()
+	defer cancel()
+	tg, err := n1.CreateTargetGroup(ctx, &httpsd.TargetGroup{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := n1.AddMember(ctx, api.Member{ID: 2, PeerURLs: peers[1:], IsLearner: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added.IsLearner || !reflect.DeepEqual(added.PeerURLs, peers[1:]) {
+		t.Errorf("added member = %+v, want a learner at %v", added, peers[1:])
+	}
+	if _, err := n1.AddMember(ctx, api.Member{ID: 2, PeerURLs: peers[1:]}); err != httpsd.ErrMemberExists {
+		t.Errorf("adding twice: err = %v, want %v", err, httpsd.ErrMemberExists)
+	}
+	n2 := startSDNode(t, t.TempDir(), 2, peers, true)
+	defer n2.stop(t)
+	if err := n2.LinearizableRead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n2.GetTargetGroup(tg.ID); err != nil {
+		t.Errorf("target group %d on the learner: %v", tg.ID, err)
+	}
+
+	promoted, err := n1.PromoteMember(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.IsLearner {
+		t.Errorf("promoted member = %+v, want a voter", promoted)
+	}
+	if _, err := n1.PromoteMember(ctx, 2); err != httpsd.ErrMemberNotLearner {
+		t.Errorf("promoting a voter: err = %v, want %v", err, httpsd.ErrMemberNotLearner)
+	}
+	if members, err := n1.Members(); err != nil || len(members) != 2 || members[1].IsLearner {
+		t.Errorf("members = %+v, %v, want two voters", members, err)
+	}
+
+	if err := n1.RemoveMember(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := n1.Members(); err != nil || len(members) != 1 || members[0].ID != 1 {
+		t.Errorf("members after removing = %+v, %v, want only member 1", members, err)
+	}
+	if err := n1.RemoveMember(ctx, 2); err != httpsd.ErrMemberNotFound {
+		t.Errorf("removing twice: err = %v, want %v", err, httpsd.ErrMemberNotFound)
+	}
+}
@@ -0,0 +1,52 @@
+package raft
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync/atomic"
+
+	"go.etcd.io/etcd/raft/v3"
+)
+
+// Status is the raft state of a node along with the transport statistics.
+type Status struct {
+	raft.Status
+	SnapshotIndex uint64
+	// ReplayIndex is the commit index read from the WAL or bolt log on
+	// startup, the log is replayed once it is applied.
+	ReplayIndex uint64
+	// PublishedIndex is the index of the last command handed to the store.
+	PublishedIndex uint64
+	WALDir         string // empty with the bolt storage
+	SnapDir        string
+	ServerStats    json.RawMessage
+	// LeaderStats holds the per-follower latencies and is only set on the leader.
+	LeaderStats json.RawMessage
+}
+
+func (rc *raftNode) Status() Status {
+	st := Status{
+		Status:         rc.node.Status(),
+		SnapshotIndex:  atomic.LoadUint64(&rc.snapshotIndex),
+		ReplayIndex:    rc.replayIndex,
+		PublishedIndex: atomic.LoadUint64(&rc.publishedDataIndex),
+		SnapDir:        absPath(rc.snapdir),
+		ServerStats:    rc.serverStats.JSON(),
+	}
+	if rc.storage == StorageWAL {
+		st.WALDir = absPath(rc.waldir)
+	}
+	if st.RaftState == raft.StateLeader {
+		st.LeaderStats = rc.leaderStats.JSON()
+	}
+	return st
+}
+
+// absPath returns the absolute form of a data directory, or dir itself
+// if it cannot be resolved.
+func absPath(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
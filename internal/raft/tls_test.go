@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/momirjalili/httpsd/internal/api"
+	"github.com/momirjalili/httpsd/internal/httpsd"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+)
+
+// testCA issues certificates for 127.0.0.1 into dir.
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	ca := &testCA{dir: t.TempDir(), serial: 1}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca.caFile, _ = ca.write(t, name, tmpl, nil, nil)
+	return ca
+}
+
+// issue writes a certificate and key for 127.0.0.1 usable by servers and
+// clients, returning the TLS files of a member trusting ca.
+func (ca *testCA) issue(t *testing.T, name string) transport.TLSInfo {
+	t.Helper()
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certFile, keyFile := ca.write(t, name, tmpl, ca.cert, ca.key)
+	return transport.TLSInfo{CertFile: certFile, KeyFile: keyFile, TrustedCAFile: ca.caFile, ClientCertAuth: true}
+}
+
+// write signs tmpl with parent, or itself if parent is nil, and writes the
+// certificate and its key as PEM files named after name.
+func (ca *testCA) write(t *testing.T, name string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.IsCA {
+		if ca.cert, err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+		ca.key = key
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// pool returns a certificate pool of the CA in caFile.
+func pool(t *testing.T, caFile string) *x509.CertPool {
+	t.Helper()
+	buf, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := x509.NewCertPool()
+	p.AppendCertsFromPEM(buf)
+	return p
+}
+
+// tlsClient returns a client presenting the certificate of info and
+// trusting its CA.
+func tlsClient(t *testing.T, info transport.TLSInfo) *http.Client {
+	t.Helper()
+	cfg, err := info.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+}
+
+// TestTLS runs a cluster whose peers and API use certificates of one CA,
+// refusing clients without TLS or with a certificate of another CA.
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t, "httpsd-ca")
+	peers := []string{"https://127.0.0.1:9091", "https://127.0.0.1:9092", "https://127.0.0.1:9093"}
+	nodes := make([]*sdNode, len(peers))
+	for i := range nodes {
+		cfg := Config{ID: i + 1, Peers: peers, TLSInfo: ca.issue(t, fmt.Sprintf("peer-%d", i+1))}
+		nodes[i] = startSDNodeConfig(t, t.TempDir(), cfg)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.stop(t)
+		}
+	}()
+	ctx, cancel := testContext()
+	defer cancel()
+	tg, err := nodes[0].CreateTargetGroup(ctx, &httpsd.TargetGroup{Targets: []httpsd.Target{{Addr: "10.0.0.1:9100"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewHttpSDServer(nodes[2].SDStore, "127.0.0.1:0", api.ForwardProxy, ca.issue(t, "api"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := fmt.Sprintf("https://%s/api/v1/target/%d/?consistency=linearizable", ln.Addr(), tg.ID)
+
+	resp, err := tlsClient(t, ca.issue(t, "client")).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got httpsd.TargetGroup
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || got.ID != tg.ID {
+		t.Errorf("GET over TLS = %d %+v, %v, want target group %d", resp.StatusCode, got, err, tg.ID)
+	}
+
+	// the server answers a plain HTTP request with a bad request
+	plain := &http.Client{Timeout: 5 * time.Second}
+	if resp, err := plain.Get(fmt.Sprintf("http://%s/api/v1/target/", ln.Addr())); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET without TLS = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	other := newTestCA(t, "other-ca")
+	wrong := other.issue(t, "client")
+	// a certificate of the other CA trusting the right one for the server
+	wrong.TrustedCAFile = ca.caFile
+	if resp, err := tlsClient(t, wrong).Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET with a certificate of another CA = %d, want a failed handshake", resp.StatusCode)
+	}
+	// a client only trusting the other CA refuses the server
+	if resp, err := tlsClient(t, other.issue(t, "client")).Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET trusting another CA = %d, want a failed handshake", resp.StatusCode)
+	}
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool(t, ca.caFile)}}, Timeout: 5 * time.Second}
+	if resp, err := anonymous.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET without a client certificate = %d, want a failed handshake", resp.StatusCode)
+	}
+}
@@ -0,0 +1,70 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/pkg/v3/idutil"
+	"go.etcd.io/etcd/pkg/v3/wait"
+)
+
+// defaultRequestTimeout bounds how long a proposal may take to be
+// committed and applied before the caller gives up on it.
+var defaultRequestTimeout = 5 * time.Second
+
+// proposalTracker assigns every proposal a request ID and lets the
+// proposer wait until the entry carrying that ID has been applied.
+// Request IDs embed the node ID, so entries proposed by other members
+// never wake up a local waiter.
+type proposalTracker struct {
+	reqIDGen *idutil.Generator
+	w        wait.Wait
+	timeout  time.Duration
+}
+
+func newProposalTracker(id int) *proposalTracker {
+	return &proposalTracker{
+		reqIDGen: idutil.NewGenerator(uint16(id), time.Now()),
+		w:        wait.New(),
+		timeout:  defaultRequestTimeout,
+	}
+}
+
+// propose encodes a proposal with a fresh request ID, sends it on proposeC
+// and blocks until it is applied, returning whatever the applier passed to
+// trigger. It fails if ctx is done or the request timeout expires first;
+// in that case the proposal may still be applied later.
+func (t *proposalTracker) propose(ctx context.Context, proposeC chan<- string, encode func(reqID uint64) (string, error)) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	id := t.reqIDGen.Next()
+	data, err := encode(id)
+	if err != nil {
+		return nil, err
+	}
+	ch := t.w.Register(id)
+	proposalsPending.Inc()
+	defer proposalsPending.Dec()
+	select {
+	case proposeC <- data:
+	case <-ctx.Done():
+		t.w.Trigger(id, nil) // GC wait
+		proposalsFailed.Inc()
+		return nil, fmt.Errorf("proposal not accepted: %w", ctx.Err())
+	}
+	select {
+	case x := <-ch:
+		return x, nil
+	case <-ctx.Done():
+		t.w.Trigger(id, nil) // GC wait
+		proposalsFailed.Inc()
+		return nil, fmt.Errorf("proposal not applied: %w", ctx.Err())
+	}
+}
+
+// trigger wakes up the proposer waiting on reqID, if it is local.
+func (t *proposalTracker) trigger(reqID uint64, x interface{}) {
+	t.w.Trigger(reqID, x)
+}
@@ -0,0 +1,152 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/momirjalili/httpsd/internal/httpsd"
+)
+
+// encodeReqID encodes a proposal as its request ID.
+func encodeReqID(reqID uint64) (string, error) {
+	return strconv.FormatUint(reqID, 10), nil
+}
+
+func TestTrackerProposeWaitsForApply(t *testing.T) {
+	tr := newProposalTracker(1)
+	proposeC := make(chan string)
+	type result struct {
+		x   interface{}
+		err error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		x, err := tr.propose(context.Background(), proposeC, encodeReqID)
+		resC <- result{x, err}
+	}()
+
+	id, err := strconv.ParseUint(<-proposeC, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case res := <-resC:
+		t.Fatalf("propose returned %v, %v before its entry was applied", res.x, res.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// entries of other proposals leave the waiter alone
+	tr.trigger(id+1, "other")
+	tr.trigger(id, "applied")
+	res := <-resC
+	if res.err != nil || res.x != "applied" {
+		t.Errorf("propose = %v, %v, want applied", res.x, res.err)
+	}
+}
+
+func TestTrackerApplyError(t *testing.T) {
+	tr := newProposalTracker(1)
+	proposeC := make(chan string)
+	defer close(proposeC)
+	go func() {
+		for data := range proposeC {
+			cmd, err := httpsd.DecodeCommand(data)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			tr.trigger(cmd.RequestID, &applyResult{cmd: cmd, err: httpsd.ErrTargetGroupNotFound})
+		}
+	}()
+	s := &SDStore{proposeC: proposeC, tracker: tr}
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := s.propose(ctx, &httpsd.Command{Op: httpsd.OpDeleteTargetGroup, GroupID: 1}); err != httpsd.ErrTargetGroupNotFound {
+		t.Errorf("propose: err = %v, want %v", err, httpsd.ErrTargetGroupNotFound)
+	}
+}
+
+func TestTrackerProposeTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		// apply reads proposals and never applies them if set, otherwise
+		// they are never accepted
+		apply bool
+	}{
+		{"not accepted", false},
+		{"not applied", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newProposalTracker(1)
+			tr.timeout = 50 * time.Millisecond
+			proposeC := make(chan string)
+			if tt.apply {
+				defer close(proposeC)
+				go func() {
+					for range proposeC {
+					}
+				}()
+			}
+			var id uint64
+			_, err := tr.propose(context.Background(), proposeC, func(reqID uint64) (string, error) {
+				id = reqID
+				return encodeReqID(reqID)
+			})
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("propose: err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if tr.w.IsRegistered(id) {
+				t.Errorf("request %d is still waited on after the timeout", id)
+			}
+		})
+	}
+}
+
+func TestTrackerConcurrentProposals(t *testing.T) {
+	tr := newProposalTracker(1)
+	proposeC := make(chan string)
+	// proposed is only read once every proposal is applied
+	proposed := map[uint64]bool{}
+	go func() {
+		for data := range proposeC {
+			id, err := strconv.ParseUint(data, 10, 64)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if proposed[id] {
+				t.Errorf("request ID %d was proposed twice", id)
+			}
+			proposed[id] = true
+			tr.trigger(id, id)
+		}
+	}()
+
+	const n = 100
+	ctx, cancel := testContext()
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var id uint64
+			x, err := tr.propose(ctx, proposeC, func(reqID uint64) (string, error) {
+				id = reqID
+				return encodeReqID(reqID)
+			})
+			if err != nil || x != id {
+				t.Errorf("propose = %v, %v, want its request ID %d", x, err, id)
+			}
+		}()
+	}
+	wg.Wait()
+	close(proposeC)
+	if len(proposed) != n {
+		t.Errorf("%d request IDs proposed, want %d", len(proposed), n)
+	}
+}